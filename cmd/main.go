@@ -3,31 +3,178 @@ package main
 import (
 	"context"
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"log/slog"
 	"os"
 	"os/signal"
+	"scanner/src/scanner"
 	"scanner/src/web"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
 func main() { // 设置日志
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: web.LogLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && a.Value.Any() == scanner.LevelTrace {
+				a.Value = slog.StringValue("TRACE")
+			}
+			return a
+		},
+	}))
 	slog.SetDefault(logger)
-
-	stopCh := make(chan struct{})
-	apiServer := web.ListenAndServe(getServerPort(), web.AddWebRoutes)
+	web.EnableTrace(os.Getenv("SCANNER_TRACE") != "")
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	web.DeviceOptions.Timing = getTimingPolicy()
+	web.DeviceOptions.RecordDir = os.Getenv("SCANNER_RECORD_DIR")
+	scanner.Emulator = getEmulatorOptions()
+	if path := os.Getenv("SCANNER_PROFILES"); path != "" {
+		if err := scanner.LoadProfiles(path); err != nil {
+			slog.Error("load device profiles", "path", path, "error", err)
+		}
+	}
+	if interval := getWatchInterval(); interval > 0 {
+		web.Watcher = scanner.NewDeviceWatcher(interval)
+		go web.Watcher.Run(ctx)
+	}
+	apiServer := web.ListenAndServe(ctx, getServerPort(), web.AddWebRoutes)
+
 	<-ctx.Done()
-	close(stopCh)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 	apiServer.Shutdown(ctx)
+	if err := web.WaitJobs(ctx); err != nil {
+		slog.Warn("scan jobs still running at exit", "error", err)
+	}
+}
+
+// getTimingPolicy 从环境变量读取设备超时和重试策略，未设置的使用默认值
+func getTimingPolicy() scanner.TimingPolicy {
+	policy := scanner.DefaultTimingPolicy
+
+	durations := map[string]*time.Duration{
+		"SCANNER_COMMAND_TIMEOUT": &policy.CommandTimeout,
+		"SCANNER_SCAN_TIMEOUT":    &policy.ScanTimeout,
+		"SCANNER_IDLE_TIMEOUT":    &policy.IdleTimeout,
+		"SCANNER_POLL_INTERVAL":   &policy.PollInterval,
+		"SCANNER_RETRY_BACKOFF":   &policy.Backoff,
+	}
+	for key, field := range durations {
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			slog.Warn("invalid duration, using default", "key", key, "value", value, "default", *field)
+			continue
+		}
+		*field = d
+	}
+
+	if value, ok := os.LookupEnv("SCANNER_RETRIES"); ok {
+		retries, err := strconv.Atoi(value)
+		if err != nil {
+			slog.Warn("invalid retries, using default", "value", value, "default", policy.Retries)
+		} else {
+			policy.Retries = retries
+		}
+	}
+
+	return policy
+}
+
+// getEmulatorOptions SCANNER_EMULATOR 不为空时启用模拟设备，无需连接扫描仪即可调试
+func getEmulatorOptions() *scanner.EmulatorOptions {
+	if os.Getenv("SCANNER_EMULATOR") == "" {
+		return nil
+	}
+	opts := &scanner.EmulatorOptions{}
+
+	if path := os.Getenv("SCANNER_EMULATOR_IMAGE"); path != "" {
+		img, err := loadImage(path)
+		if err != nil {
+			slog.Warn("load emulator image, using test pattern", "path", path, "error", err)
+		} else {
+			opts.Image = img
+		}
+	}
+	if value, ok := os.LookupEnv("SCANNER_EMULATOR_SHEETS"); ok {
+		sheets, err := strconv.Atoi(value)
+		if err != nil {
+			slog.Warn("invalid emulator sheets, using default", "value", value)
+		} else {
+			opts.Sheets = sheets
+		}
+	}
+	if value, ok := os.LookupEnv("SCANNER_EMULATOR_DELAY"); ok {
+		delay, err := time.ParseDuration(value)
+		if err != nil {
+			slog.Warn("invalid emulator delay, using default", "value", value)
+		} else {
+			opts.Delay = delay
+		}
+	}
+
+	faults := map[string]error{
+		"no_paper":   scanner.ErrNoPaper,
+		"paper_jam":  scanner.ErrPaperJam,
+		"cover_open": scanner.ErrCoverOpen,
+		"busy":       scanner.ErrDeviceBusy,
+	}
+	if value, ok := os.LookupEnv("SCANNER_EMULATOR_FAULT"); ok {
+		fault, ok := faults[value]
+		if !ok {
+			slog.Warn("unknown emulator fault, ignoring", "value", value)
+		} else {
+			opts.Fault = fault
+		}
+	}
+	if value, ok := os.LookupEnv("SCANNER_EMULATOR_FAULT_AFTER"); ok {
+		after, err := strconv.Atoi(value)
+		if err != nil {
+			slog.Warn("invalid emulator fault sheet, using default", "value", value)
+		} else {
+			opts.FaultAfter = after
+		}
+	}
+
+	slog.Info("scanner emulator enabled", "device", scanner.EmulatorDevice.ID)
+	return opts
+}
+
+func loadImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// getWatchInterval 扫描仪清单的轮询间隔，为 0 时不在后台监控设备
+func getWatchInterval() time.Duration {
+	interval := 2 * time.Second
+	if value, ok := os.LookupEnv("SCANNER_WATCH_INTERVAL"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			slog.Warn("invalid watch interval, using default", "value", value, "default", interval)
+			return interval
+		}
+		interval = d
+	}
+	return interval
 }
 
 func getServerPort() string {
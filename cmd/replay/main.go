@@ -0,0 +1,80 @@
+// replay 回放 SCANNER_RECORD_DIR 录制的USB会话，离线复现用户反馈的扫描问题
+//
+//	go run ./cmd/replay -options '{"DPI":300,"Mode":"CGRAY"}' -out ./replay 20250101T120000.000-04f9_0000.jsonl
+//
+// -options 需要和录制时的扫描参数一致，否则回放会在第一条不同的命令处报错。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"scanner/src/scanner"
+)
+
+func main() {
+	options := flag.String("options", "", "录制时的扫描参数（ScanOptions 的 JSON），为空时使用默认参数")
+	out := flag.String("out", ".", "扫描结果的输出目录")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: replay [-options JSON] [-out DIR] RECORDING")
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), *options, *out); err != nil {
+		slog.Error("replay failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(recording, options, out string) error {
+	opts := scanner.DefaultScanOptions
+	if options != "" {
+		if err := json.Unmarshal([]byte(options), &opts); err != nil {
+			return fmt.Errorf("parse options: %w", err)
+		}
+	}
+
+	dial := func() (scanner.Transport, error) {
+		f, err := os.Open(recording)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		transport, err := scanner.NewReplayTransport(f)
+		if err != nil {
+			return nil, fmt.Errorf("read recording: %w", err)
+		}
+		return transport, nil
+	}
+
+	ctx := context.Background()
+	scan := scanner.NewTransportScanner(scanner.DeviceInfo{}, dial, scanner.DefaultDeviceOptions)
+	if err := scan.Connect(ctx); err != nil {
+		return err
+	}
+	defer scan.Disconnect()
+
+	pages, err := scan.ScanPages(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	for _, page := range pages {
+		name := filepath.Join(out, fmt.Sprintf("page-%d%s", page.Index+1, page.Format.Ext()))
+		if err := os.WriteFile(name, page.Data, 0644); err != nil {
+			return err
+		}
+		slog.Info("page written", "file", name, "bytes", len(page.Data))
+	}
+	return nil
+}
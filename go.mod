@@ -5,6 +5,7 @@ go 1.24.2
 require (
 	github.com/gin-gonic/gin v1.11.0
 	github.com/google/gousb v1.1.3
+	golang.org/x/image v0.25.0
 )
 
 require (
@@ -0,0 +1,116 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+/*
+Capabilities 设备能力，由 ESC Q 的响应解析而来
+
+Response (M7206):
+0040   c1 00 1c 09 ff 3f 00 00 00 00 00 00 00 01 04 01   .....?..........
+0050   01 01 01 01 00 00 00 00 00 00 00 00 00 01         ..............
+
+The layout is a best guess from the single M7206 capture above, the
+resolution and mode tables follow the order of the ESC I values and the
+source bits were checked against the M7206 only. The M7206 sets every
+resolution bit up to 19200 dpi, most of them interpolated, so the result
+is clamped with DeviceProfile.MaxResolution:
+
+	[0]      0xc1, response marker
+	[1:3]    payload length, big endian
+	[3]      source bitmask: 0x01 flatbed, 0x02 duplex, 0x08 ADF
+	[4:6]    resolution bitmask, little endian, indexes capabilityResolutions
+	[6:8]    max scan width in 0.1mm, little endian, 0 when not reported
+	[8:10]   max scan height in 0.1mm, little endian, 0 when not reported
+	[15:20]  one byte per entry of capabilityModes, non-zero when supported
+
+Everything else is unknown and only kept in Raw.
+*/
+type Capabilities struct {
+	Resolutions []uint16
+	Modes       []ScanMode
+	Flatbed     bool
+	ADF         bool
+	Duplex      bool
+	// All in [mm]
+	MaxWidth  float64
+	MaxHeight float64
+
+	Raw []byte
+}
+
+const (
+	capabilitySourceFlatbed = 0x01
+	capabilitySourceDuplex  = 0x02
+	capabilitySourceADF     = 0x08
+)
+
+var capabilityResolutions = [...]uint16{75, 100, 150, 200, 240, 300, 400, 600, 800, 1200, 2400, 4800, 9600, 19200}
+
+var capabilityModes = [...]ScanMode{ScanModeText, ScanModeErrorDiffusion, ScanModeTrueGray, ScanModeC256, ScanModeCGRAY}
+
+func (c *Capabilities) parse(d []byte) error {
+	if len(d) < 20 {
+		return fmt.Errorf("too short: %d bytes", len(d))
+	}
+	if d[0] != 0xc1 {
+		return fmt.Errorf("unexpected marker 0x%02x", d[0])
+	}
+
+	c.Raw = slices.Clone(d)
+
+	sources := d[3]
+	c.Flatbed = sources&capabilitySourceFlatbed != 0
+	c.ADF = sources&capabilitySourceADF != 0
+	c.Duplex = c.ADF && sources&capabilitySourceDuplex != 0
+
+	resolutions := binary.LittleEndian.Uint16(d[4:6])
+	c.Resolutions = c.Resolutions[:0]
+	for i, dpi := range capabilityResolutions {
+		if resolutions&(1<<i) != 0 {
+			c.Resolutions = append(c.Resolutions, dpi)
+		}
+	}
+
+	c.MaxWidth = float64(binary.LittleEndian.Uint16(d[6:8])) / 10
+	c.MaxHeight = float64(binary.LittleEndian.Uint16(d[8:10])) / 10
+	if c.MaxWidth == 0 || c.MaxHeight == 0 {
+		c.MaxWidth, c.MaxHeight = DefaultScanOptions.Width, DefaultScanOptions.Height
+	}
+
+	c.Modes = c.Modes[:0]
+	for i, mode := range capabilityModes {
+		if d[15+i] != 0 {
+			c.Modes = append(c.Modes, mode)
+		}
+	}
+
+	return nil
+}
+
+// SupportsResolution 设备是否支持该分辨率，设备未上报时视为支持
+func (c *Capabilities) SupportsResolution(dpi uint16) bool {
+	return len(c.Resolutions) == 0 || slices.Contains(c.Resolutions, dpi)
+}
+
+// SupportsSource 设备是否具备该纸张来源
+func (c *Capabilities) SupportsSource(source ScanSource) bool {
+	switch source {
+	case ScanSourceFlatbed:
+		return c.Flatbed
+	case ScanSourceADF:
+		return c.ADF
+	case ScanSourceADFDuplex:
+		return c.Duplex
+	default:
+		return false
+	}
+}
+
+// SupportsMode 设备是否支持该扫描模式，设备未上报时视为支持
+func (c *Capabilities) SupportsMode(mode ScanMode) bool {
+	return len(c.Modes) == 0 || slices.Contains(c.Modes, mode)
+}
@@ -0,0 +1,62 @@
+package scanner
+
+import (
+	"slices"
+	"testing"
+)
+
+// m7206Capabilities ESC Q 的响应，抓取自 Lenovo M7206
+var m7206Capabilities = []byte{
+	0xc1, 0x00, 0x1c, 0x09, 0xff, 0x3f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x04, 0x01,
+	0x01, 0x01, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+}
+
+func TestCapabilitiesParseM7206(t *testing.T) {
+	var caps Capabilities
+	if err := caps.parse(m7206Capabilities); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if !caps.Flatbed || !caps.ADF || caps.Duplex {
+		t.Errorf("sources: flatbed %v, ADF %v, duplex %v, want flatbed and ADF", caps.Flatbed, caps.ADF, caps.Duplex)
+	}
+	if !slices.Equal(caps.Resolutions, capabilityResolutions[:]) {
+		t.Errorf("resolutions %v, want %v", caps.Resolutions, capabilityResolutions)
+	}
+	if !slices.Equal(caps.Modes, capabilityModes[:]) {
+		t.Errorf("modes %v, want %v", caps.Modes, capabilityModes)
+	}
+	if caps.MaxWidth != DefaultScanOptions.Width || caps.MaxHeight != DefaultScanOptions.Height {
+		t.Errorf("size %vx%v, want the default %vx%v", caps.MaxWidth, caps.MaxHeight,
+			DefaultScanOptions.Width, DefaultScanOptions.Height)
+	}
+
+	profile, ok := LookupProfile(DeviceInfo{VendorID: "0x17ef", ProductID: "0x5629"})
+	if !ok {
+		t.Fatal("no profile for the M7206")
+	}
+	profile.applyCapabilities(&caps)
+	want := []uint16{75, 100, 150, 200, 240, 300, 400, 600, 800, 1200}
+	if !slices.Equal(caps.Resolutions, want) {
+		t.Errorf("clamped resolutions %v, want %v", caps.Resolutions, want)
+	}
+}
+
+func TestCapabilitiesParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", m7206Capabilities[:19]},
+		{"marker", append([]byte{0xc2}, m7206Capabilities[1:]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var caps Capabilities
+			if err := caps.parse(tt.data); err == nil {
+				t.Error("parse succeeded, want an error")
+			}
+		})
+	}
+}
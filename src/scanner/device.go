@@ -1,33 +1,118 @@
 package scanner
 
 import (
+	"fmt"
 	"log/slog"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/gousb"
 )
 
 type (
 	ScanMode    string
+	ScanSource  string
 	Compression string
+	PixelFormat string
 )
 
 // ScanMode represents the scanning mode for the scanner.
-// Black & White|Gray[Error Diffusion]|True Gray|24bit Color|24bit Color[Fast] [24bit Color[Fast]]
-var (
-	ScanModeCGRAY ScanMode = "CGRAY"
+// Black & White|Gray[Error Diffusion]|True Gray|256 Color|24bit Color
+const (
+	ScanModeText           ScanMode = "TEXT"   // Black & White
+	ScanModeErrorDiffusion ScanMode = "ERRDIF" // Gray[Error Diffusion]
+	ScanModeTrueGray       ScanMode = "GRAY64" // True Gray
+	ScanModeC256           ScanMode = "C256"   // 256 Color
+	ScanModeCGRAY          ScanMode = "CGRAY"  // 24bit Color
+
+	ScanSourceFlatbed   ScanSource = "FLATBED"    // 平板玻璃
+	ScanSourceADF       ScanSource = "ADF"        // 自动进纸器，单面
+	ScanSourceADFDuplex ScanSource = "ADF_DUPLEX" // 自动进纸器，双面
 
 	CompressionJPEG    Compression = "JPEG"
 	CompressionRLENGTH Compression = "RLENGTH"
+
+	PixelFormatMono    PixelFormat = "MONO"    // 1 bit per pixel, 1 is black
+	PixelFormatGray    PixelFormat = "GRAY"    // 8 bit gray
+	PixelFormatIndexed PixelFormat = "INDEXED" // 8 bit, 256 color palette
+	PixelFormatRGB     PixelFormat = "RGB"     // 24 bit RGB
 )
 
+// ScanModes 所有支持的扫描模式
+var ScanModes = []ScanMode{
+	ScanModeText,
+	ScanModeErrorDiffusion,
+	ScanModeTrueGray,
+	ScanModeC256,
+	ScanModeCGRAY,
+}
+
+// Validate 检查是否为已知的扫描模式
+func (mode ScanMode) Validate() error {
+	if !slices.Contains(ScanModes, mode) {
+		return fmt.Errorf("unsupported scan mode %q", mode)
+	}
+	return nil
+}
+
+// Validate 检查是否为已知的纸张来源
+func (source ScanSource) Validate() error {
+	switch source {
+	case ScanSourceFlatbed, ScanSourceADF, ScanSourceADFDuplex:
+		return nil
+	default:
+		return fmt.Errorf("unsupported scan source %q", source)
+	}
+}
+
+// command 发送给设备的 ESC D 参数
+func (source ScanSource) command() string {
+	switch source {
+	case ScanSourceFlatbed:
+		return "FB"
+	case ScanSourceADFDuplex:
+		return "DUP"
+	default:
+		return "ADF"
+	}
+}
+
+// PixelFormat 扫描模式对应的输出像素格式
+func (mode ScanMode) PixelFormat() PixelFormat {
+	switch mode {
+	case ScanModeText, ScanModeErrorDiffusion:
+		return PixelFormatMono
+	case ScanModeTrueGray:
+		return PixelFormatGray
+	case ScanModeC256:
+		return PixelFormatIndexed
+	default:
+		return PixelFormatRGB
+	}
+}
+
+// BitsPerPixel 每个像素占用的位数
+func (format PixelFormat) BitsPerPixel() int {
+	switch format {
+	case PixelFormatMono:
+		return 1
+	case PixelFormatGray, PixelFormatIndexed:
+		return 8
+	default:
+		return 24
+	}
+}
+
 var DefaultDeviceOptions = DeviceOptions{
 	ConfigNum:      1,
 	InterfaceNum:   1,
 	InterfaceAlt:   0,
 	OutEndpointNum: 4,
 	InEndpointNum:  5,
+	AutoDetect:     true,
+	Timing:         DefaultTimingPolicy,
 }
 
 type DeviceOptions struct {
@@ -36,21 +121,191 @@ type DeviceOptions struct {
 	InterfaceAlt   int
 	OutEndpointNum int
 	InEndpointNum  int
+	// AutoDetect 打开设备时从USB描述符中查找扫描接口和端点，找不到时使用上面的值
+	AutoDetect bool
+
+	Timing TimingPolicy
+	// RecordDir 不为空时将每次连接的USB传输录制到该目录，见 RecordingTransport
+	RecordDir string
+}
+
+var DefaultTimingPolicy = TimingPolicy{
+	CommandTimeout: 3 * time.Second,
+	ScanTimeout:    10 * time.Minute,
+	IdleTimeout:    30 * time.Second,
+	PollInterval:   30 * time.Millisecond,
+	Retries:        3,
+	Backoff:        100 * time.Millisecond,
+}
+
+// TimingPolicy 超时和重试策略，为零的字段使用 DefaultTimingPolicy 中的值
+type TimingPolicy struct {
+	// CommandTimeout 发送一条命令并等待响应的最长时间
+	CommandTimeout time.Duration
+	// ScanTimeout 整个扫描任务的最长时间
+	ScanTimeout time.Duration
+	// IdleTimeout 扫描过程中两次收到数据之间的最长间隔
+	IdleTimeout time.Duration
+	// PollInterval 设备返回空数据包后再次读取前的等待时间
+	PollInterval time.Duration
+	// Retries 遇到暂时性USB错误（如端点 stall）时的重试次数，为负数时不重试
+	Retries int
+	// Backoff 第一次重试前的等待时间，之后每次翻倍
+	Backoff time.Duration
+}
+
+func (policy TimingPolicy) withDefaults() TimingPolicy {
+	def := DefaultTimingPolicy
+	if policy.CommandTimeout <= 0 {
+		policy.CommandTimeout = def.CommandTimeout
+	}
+	if policy.ScanTimeout <= 0 {
+		policy.ScanTimeout = def.ScanTimeout
+	}
+	if policy.IdleTimeout <= 0 {
+		policy.IdleTimeout = def.IdleTimeout
+	}
+	if policy.PollInterval <= 0 {
+		policy.PollInterval = def.PollInterval
+	}
+	switch {
+	case policy.Retries == 0:
+		policy.Retries = def.Retries
+	case policy.Retries < 0:
+		policy.Retries = 0
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = def.Backoff
+	}
+	return policy
 }
 
 // DeviceInfo 设备基本信息
 // lsusb 输出信息里的 VendorID:ProductID
 // 例如：Bus 001 Device 002: ID 17ef:5629 Lenovo M7206
 type DeviceInfo struct {
+	ID        string
 	Name      string
 	VendorID  string
 	ProductID string
+
+	// 设备的字符串描述符
+	Manufacturer string
+	Product      string
+	SerialNumber string
+	// Path 总线和端口路径，例如 1-1.2 为总线 1 上根集线器端口 1 下的集线器端口 2
+	Path string
+	// Profile 匹配到的型号参数名称
+	Profile string
 }
 
 // Transfer 统一规则取核心数据
 func (info *DeviceInfo) Transfer(desc *gousb.DeviceDesc) {
 	info.VendorID = "0x" + desc.Vendor.String()
 	info.ProductID = "0x" + desc.Product.String()
+	info.ID = desc.Vendor.String() + ":" + desc.Product.String()
+	info.Path = usbPath(desc)
+}
+
+// usbPath 和 Linux sysfs 中的设备名相同，例如 1-1.2
+func usbPath(desc *gousb.DeviceDesc) string {
+	ports := make([]string, len(desc.Path))
+	for i, port := range desc.Path {
+		ports[i] = strconv.Itoa(port)
+	}
+	return fmt.Sprintf("%d-%s", desc.Bus, strings.Join(ports, "."))
+}
+
+/*
+ParseDeviceID 解析 API 路径中的设备ID，格式同 lsusb，例如：17ef:5629
+
+连接了多台相同型号时，设备列表返回的ID带有指定某一台的后缀：
+
+	17ef:5629@E12345A6B789012   序列号
+	17ef:5629@usb:1-1.2         USB端口路径，序列号为空或重复时使用
+*/
+func ParseDeviceID(id string) (DeviceInfo, error) {
+	model, selector, _ := strings.Cut(id, "@")
+	vendor, product, ok := strings.Cut(model, ":")
+	if !ok {
+		return DeviceInfo{}, fmt.Errorf("invalid device ID %q, example: 17ef:5629", id)
+	}
+	for _, part := range []string{vendor, product} {
+		if _, err := strconv.ParseUint(part, 16, 16); err != nil {
+			return DeviceInfo{}, fmt.Errorf("invalid device ID %q, example: 17ef:5629", id)
+		}
+	}
+
+	info := DeviceInfo{
+		ID:        id,
+		VendorID:  "0x" + vendor,
+		ProductID: "0x" + product,
+	}
+	if path, ok := strings.CutPrefix(selector, "usb:"); ok {
+		info.Path = path
+	} else {
+		info.SerialNumber = selector
+	}
+	return info, nil
+}
+
+// assignIDs 在ID后加上序列号，使每台设备都有稳定的ID，序列号为空或重复时使用USB端口路径
+func assignIDs(list []DeviceInfo) {
+	serials := map[string]int{}
+	for _, info := range list {
+		if info.SerialNumber != "" {
+			serials[info.ID+"@"+info.SerialNumber]++
+		}
+	}
+	for i, info := range list {
+		switch {
+		case info.IsEmulator():
+		case info.SerialNumber != "" && serials[info.ID+"@"+info.SerialNumber] == 1:
+			list[i].ID = info.ID + "@" + info.SerialNumber
+		case info.Path != "":
+			list[i].ID = info.ID + "@usb:" + info.Path
+		}
+	}
+}
+
+// openDevice 打开 info 指定的那一台设备，按序列号和USB端口路径中不为空的字段匹配，
+// 都为空且有多台相同型号时打开端口路径最小的一台
+func openDevice(ctx *gousb.Context, info DeviceInfo) (*gousb.Device, error) {
+	vendorID, productID := info.ParseVendorID(), info.ParseProductID()
+	devices, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		return uint16(desc.Vendor) == vendorID && uint16(desc.Product) == productID &&
+			(info.Path == "" || usbPath(desc) == info.Path)
+	})
+	slices.SortFunc(devices, func(a, b *gousb.Device) int {
+		return strings.Compare(usbPath(a.Desc), usbPath(b.Desc))
+	})
+
+	var selected *gousb.Device
+	for _, device := range devices {
+		if selected == nil && info.matchSerial(device) {
+			selected = device
+			continue
+		}
+		device.Close()
+	}
+	if selected == nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, info.ID)
+	}
+	if len(devices) > 1 && info.SerialNumber == "" && info.Path == "" {
+		slog.Warn("several identical devices attached, using the first one", "device", info.ID, "path", usbPath(selected.Desc))
+	}
+	return selected, nil
+}
+
+func (info *DeviceInfo) matchSerial(device *gousb.Device) bool {
+	if info.SerialNumber == "" {
+		return true
+	}
+	serial, err := device.SerialNumber()
+	return err == nil && serial == info.SerialNumber
 }
 
 // ParseVendorID 将设备ID解析为整型
@@ -72,18 +327,52 @@ func ParseID(id string) uint16 {
 	return uint16(number)
 }
 
-// ListUSBDevice 获取机器上的所有USB设备
+// scannerVendors 生产 Brother 协议扫描仪的厂商
+var scannerVendors = map[gousb.ID]string{
+	0x04f9: "Brother",
+	0x17ef: "Lenovo",
+}
+
+// isScanner 已登记的型号，或已知厂商带有扫描接口的设备
+func isScanner(desc *gousb.DeviceDesc) bool {
+	info := DeviceInfo{}
+	info.Transfer(desc)
+	if _, known := LookupProfile(info); known {
+		return true
+	}
+	if _, ok := scannerVendors[desc.Vendor]; !ok {
+		return false
+	}
+	_, err := discoverInterface(desc)
+	return err == nil
+}
+
+// ListUSBDevice 获取机器上的扫描仪，只打开已知厂商的扫描仪以读取名称和序列号
 func ListUSBDevice() []DeviceInfo {
+	var deviceList []DeviceInfo
+	if Emulator != nil {
+		deviceList = append(deviceList, EmulatorDevice)
+	}
+
 	ctx := gousb.NewContext()
 	defer ctx.Close()
 
+	var busy []DeviceInfo
 	devices, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
-		return true // 打开所有设备以获取信息
+		if !isScanner(desc) {
+			return false
+		}
+		// 正在扫描的设备不再打开，避免干扰扫描，使用扫描开始时的信息
+		if info, ok := inUseDevice(usbPath(desc)); ok {
+			info.Transfer(desc)
+			busy = append(busy, info)
+			return false
+		}
+		return true
 	})
-
 	if err != nil {
-		slog.Error("Failed to list USB devices", "error", err)
-		return nil
+		// 部分设备没有权限打开时仍会返回其他设备
+		slog.Error("Failed to open some USB devices", "error", err)
 	}
 
 	defer func() {
@@ -92,29 +381,49 @@ func ListUSBDevice() []DeviceInfo {
 		}
 	}()
 
-	var deviceList []DeviceInfo
+	start := len(deviceList)
 	for _, device := range devices {
-		if device.Desc == nil {
-			continue
-		}
-
-		// 尝试获取产品名称
-		name, err := device.Manufacturer()
-		if err != nil {
-			slog.Error("Failed to get USB device name", "error", err)
-		}
-		// 白名单，现在只支持
-		if strings.Contains(strings.ToLower(name), "xhci") {
-			continue
-		}
-
-		deviceInfo := DeviceInfo{
-			Name: name,
-		}
+		deviceInfo := DeviceInfo{}
 		deviceInfo.Transfer(device.Desc)
-
+		deviceInfo.describe(device)
 		deviceList = append(deviceList, deviceInfo)
 	}
+	deviceList = append(deviceList, busy...)
+	slices.SortStableFunc(deviceList[start:], func(a, b DeviceInfo) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	assignIDs(deviceList)
 
 	return deviceList
 }
+
+// describe 读取设备的字符串描述符，读取失败的字段留空
+func (info *DeviceInfo) describe(device *gousb.Device) {
+	var err error
+	if info.Manufacturer, err = device.Manufacturer(); err != nil {
+		slog.Warn("Failed to get USB device manufacturer", "device", info.ID, "error", err)
+	}
+	if info.Product, err = device.Product(); err != nil {
+		slog.Warn("Failed to get USB device product", "device", info.ID, "error", err)
+	}
+	if info.SerialNumber, err = device.SerialNumber(); err != nil {
+		slog.Warn("Failed to get USB device serial number", "device", info.ID, "error", err)
+	}
+
+	if profile, known := LookupProfile(*info); known {
+		info.Profile = profile.Name
+	}
+
+	manufacturer := info.Manufacturer
+	if manufacturer == "" {
+		manufacturer = scannerVendors[device.Desc.Vendor]
+	}
+	switch {
+	case info.Product == "" && info.Profile != "":
+		info.Name = info.Profile
+	case strings.Contains(strings.ToLower(info.Product), strings.ToLower(manufacturer)):
+		info.Name = info.Product
+	default:
+		info.Name = strings.TrimSpace(manufacturer + " " + info.Product)
+	}
+}
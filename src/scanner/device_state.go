@@ -1,12 +1,18 @@
 package scanner
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/google/gousb"
 )
 
+var _ Transport = (*DeviceState)(nil)
+
+// DeviceState 基于 gousb 的 Transport 实现
 type DeviceState struct {
 	ctx    *gousb.Context
 	device *gousb.Device
@@ -15,6 +21,9 @@ type DeviceState struct {
 	cif *gousb.Interface
 	out *gousb.OutEndpoint
 	in  *gousb.InEndpoint
+
+	// iface 实际使用的接口和端点
+	iface InterfaceReport
 }
 
 func (ds *DeviceState) Close() (err error) {
@@ -39,56 +48,135 @@ func (ds *DeviceState) Close() (err error) {
 	return err
 }
 
-func open(vendorID, productID uint16, opts DeviceOptions) *DeviceState {
+func (ds *DeviceState) Control(ctx context.Context, rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	// gousb 的控制传输不支持 context，只能在开始前检查
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := ds.device.Control(rType, request, val, idx, data)
+	return n, deviceGone(err)
+}
+
+func (ds *DeviceState) Write(ctx context.Context, p []byte) (int, error) {
+	n, err := ds.out.WriteContext(ctx, p)
+	ds.clearHalt(ds.out.Desc.Address, err)
+	return n, deviceGone(err)
+}
+
+func (ds *DeviceState) Read(ctx context.Context, p []byte) (int, error) {
+	n, err := ds.in.ReadContext(ctx, p)
+	ds.clearHalt(ds.in.Desc.Address, err)
+	return n, deviceGone(err)
+}
+
+// CLEAR_FEATURE(ENDPOINT_HALT) 的请求，gousb 没有提供 libusb_clear_halt
+const (
+	requestTypeEndpoint = 0x02 // host to device, standard, endpoint
+	requestClearFeature = 0x01
+	featureEndpointHalt = 0x00
+)
+
+// clearHalt 端点 stall 后设备会拒绝之后的所有传输，返回错误前清除 halt，重试才能成功
+func (ds *DeviceState) clearHalt(addr gousb.EndpointAddress, err error) {
+	if !errors.Is(err, gousb.TransferStall) && !errors.Is(err, gousb.ErrorPipe) {
+		return
+	}
+	if _, cerr := ds.device.Control(requestTypeEndpoint, requestClearFeature, featureEndpointHalt, uint16(addr), nil); cerr != nil {
+		slog.Warn("clear endpoint halt", "endpoint", addr, "error", cerr)
+	}
+}
+
+// deviceGone 设备被拔出后 libusb 返回 ErrorNoDevice
+func deviceGone(err error) error {
+	if errors.Is(err, gousb.ErrorNoDevice) {
+		return fmt.Errorf("%w: %w", ErrDeviceGone, err)
+	}
+	return err
+}
+
+// open 打开并占用设备的扫描接口，失败时释放已打开的资源，
+// 错误可以用 errors.Is 判断 ErrPermissionDenied、ErrDeviceInUse 和 ErrDeviceNotFound
+func open(info DeviceInfo, opts DeviceOptions) (*DeviceState, error) {
 	state := &DeviceState{
 		ctx: gousb.NewContext(),
 	}
-	dev, err := state.ctx.OpenDeviceWithVIDPID(gousb.ID(vendorID), gousb.ID(productID))
+	fail := func(err error) (*DeviceState, error) {
+		state.Close()
+		return nil, classifyUSBError(err)
+	}
+
+	dev, err := openDevice(state.ctx, info)
 	if err != nil {
-		log.Printf(err.Error())
-		return state
+		return fail(err)
 	}
 	state.device = dev
 
+	// 扫描接口被 usblp 等内核驱动绑定时需要先解绑，释放接口后 gousb 会重新绑定
+	if err := dev.SetAutoDetach(true); err != nil {
+		slog.Debug("enable kernel driver auto detach", "device", info.ID, "error", err)
+	}
+
+	state.iface = selectInterface(dev.Desc, opts)
+	opts = state.iface.apply(opts)
+	slog.Info("usb scanner interface selected", "device", dev.Desc.String(), "interface", state.iface.InterfaceNum,
+		"out", state.iface.OutEndpointNum, "in", state.iface.InEndpointNum, "source", state.iface.Source, "note", state.iface.Note)
+
 	state.cfg, err = state.device.Config(opts.ConfigNum)
 	if err != nil {
-		log.Printf("select usb device config: %w", err)
-		return state
+		return fail(fmt.Errorf("select usb device config %d: %w", opts.ConfigNum, err))
 	}
 
 	state.cif, err = state.cfg.Interface(opts.InterfaceNum, opts.InterfaceAlt)
 	if err != nil {
-		log.Printf("claim usb device interface: %w", err)
-		return state
+		return fail(fmt.Errorf("claim usb device interface %d: %w", opts.InterfaceNum, err))
 	}
 
 	state.out, err = state.cif.OutEndpoint(opts.OutEndpointNum)
 	if err != nil {
-		log.Printf("open out endpoint: %w", err)
-		return state
+		return fail(fmt.Errorf("open out endpoint %d: %w", opts.OutEndpointNum, err))
 	}
 
 	state.in, err = state.cif.InEndpoint(opts.InEndpointNum)
 	if err != nil {
-		log.Printf("open in endpoint: %w", err)
-		return state
+		return fail(fmt.Errorf("open in endpoint %d: %w", opts.InEndpointNum, err))
 	}
 
-	return state
+	return state, nil
+}
+
+// classifyUSBError 将 libusb 的错误归类，便于给出处理建议
+func classifyUSBError(err error) error {
+	switch {
+	case errors.Is(err, ErrPermissionDenied), errors.Is(err, ErrDeviceInUse), errors.Is(err, ErrDeviceNotFound):
+		return err
+	case errors.Is(err, gousb.ErrorAccess):
+		return fmt.Errorf("%w: %w", ErrPermissionDenied, err)
+	case errors.Is(err, gousb.ErrorBusy):
+		return fmt.Errorf("%w: %w", ErrDeviceInUse, err)
+	case errors.Is(err, gousb.ErrorNotFound), errors.Is(err, gousb.ErrorNoDevice):
+		return fmt.Errorf("%w: %w", ErrDeviceNotFound, err)
+	default:
+		return err
+	}
 }
 
 type scanRequest struct {
 	horizontalDPI, verticalDPI uint16
 	mode                       ScanMode
 	compression                Compression
-	brightness                 uint16 // 50
-	contrast                   uint16 // 50
+	brightness                 uint16 // 0-100, default 50
+	contrast                   uint16 // 0-100, default 50
 	left, top, width, height   uint16
+	duplex                     bool
 }
 
 func (req scanRequest) Bytes() []byte {
-	executeScan := "\x1bX\x0aR=%d,%d\x0aM=%s\x0aC=%s\x0aJ=MID\x0aB=%d\x0aN=%d\x0aA=%d,%d,%d,%d\x0aS=NORMAL_SCAN\x0aP=0\x0aG=0\x0aL=0\x0a\x80"
-	return []byte(fmt.Sprintf(executeScan, req.horizontalDPI, req.verticalDPI, req.mode, req.compression, req.brightness, req.contrast, req.left, req.top, req.width, req.height))
+	executeScan := "\x1bX\x0aR=%d,%d\x0aM=%s\x0aC=%s\x0aJ=MID\x0aB=%d\x0aN=%d\x0aA=%d,%d,%d,%d\x0aS=%s\x0aP=0\x0aG=0\x0aL=0\x0a\x80"
+	scanType := "NORMAL_SCAN"
+	if req.duplex {
+		scanType = "DUPLEX_SCAN"
+	}
+	return []byte(fmt.Sprintf(executeScan, req.horizontalDPI, req.verticalDPI, req.mode, req.compression, req.brightness, req.contrast, req.left, req.top, req.width, req.height, scanType))
 }
 
 type negotiateResponse struct {
@@ -111,6 +199,79 @@ func (nr *negotiateResponse) parse(d []byte) error {
 	return nil
 }
 
+/*
+Every block of scan data starts with a header. JPEG blocks use 12 bytes:
+
+0000   64 07 00 01 00 00 00 00 00 00 f4 3f ff d8 ff e0   d...........
+
+	[0]      block type, 0x64 for JPEG data
+	[1:3]    always 07 00
+	[3:5]    page number, little endian
+	[5:10]   unknown, always zero so far
+	[10:12]  payload length, little endian
+
+Models with a different header length are configured with
+DeviceProfile.JPEGHeaderSize, the payload length is always in the last
+two bytes of the header.
+
+RLENGTH scan lines use 3 bytes, the line type (0x40-0x4e, see
+DecodeRLENGTH) followed by the little endian payload length.
+*/
+type frameHeader struct {
+	blockType byte
+	page      uint16
+	length    int
+}
+
+const (
+	frameJPEG = 0x64
+	// framePreamble 有时出现在块之前的前导字节的第一个字节，见 readScanData
+	framePreamble = 0x00
+	// maxPreambleSize 查找前导字节之后的块头时最多读取的字节数
+	maxPreambleSize = 64
+)
+
+var jpegBlockPrefix = []byte{frameJPEG, 0x07, 0x00}
+
+// frameHeaderSize 块头长度，未知的块类型返回 0，JPEG 块头的长度由型号决定
+func frameHeaderSize(blockType byte, jpegHeader int) int {
+	switch {
+	case blockType == frameJPEG:
+		return jpegHeader
+	case blockType >= rasterLineGray && blockType <= rasterLineBlue|rasterCompressed && blockType&0x01 == 0:
+		return 3
+	default:
+		return 0
+	}
+}
+
+func (fh *frameHeader) parse(d []byte, jpegHeader int) error {
+	size := frameHeaderSize(d[0], jpegHeader)
+	if size == 0 {
+		return fmt.Errorf("unknown block type 0x%02x", d[0])
+	}
+	if len(d) < size {
+		return fmt.Errorf("header of block 0x%02x too short: %d bytes", d[0], len(d))
+	}
+
+	fh.blockType = d[0]
+	if fh.blockType != frameJPEG {
+		fh.length = int(binary.LittleEndian.Uint16(d[1:3]))
+		return nil
+	}
+
+	if d[1] != 0x07 || d[2] != 0x00 {
+		return fmt.Errorf("unexpected JPEG block header % x", d[:size])
+	}
+	fh.page = binary.LittleEndian.Uint16(d[3:5])
+	fh.length = int(binary.LittleEndian.Uint16(d[size-2 : size]))
+	return nil
+}
+
+var selectSourceRequest = func(source ScanSource) []byte {
+	return []byte(fmt.Sprintf("\x1bD\x0a%s\x0a\x80", source.command()))
+}
+
 var negotiateRequest = func(resolution uint16, mode ScanMode) []byte {
 	return []byte(fmt.Sprintf("\x1bI\x0aR=%d,%d\x0aM=%s\x0a\x80", resolution, resolution, mode))
 }
@@ -0,0 +1,178 @@
+package scanner
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/google/gousb"
+)
+
+// InterfaceSource 扫描接口参数的来源
+type InterfaceSource string
+
+const (
+	InterfaceFromProfile    InterfaceSource = "PROFILE"    // 型号参数或 DeviceOptions 中指定
+	InterfaceFromDescriptor InterfaceSource = "DESCRIPTOR" // 从USB描述符中找到
+	InterfaceFromDefault    InterfaceSource = "DEFAULT"    // 描述符中没有找到，使用 DeviceOptions 中的默认值
+	InterfaceFromEmulator   InterfaceSource = "EMULATOR"   // 模拟设备没有USB接口
+)
+
+// InterfaceReport 打开设备时使用的配置、接口和端点
+type InterfaceReport struct {
+	ConfigNum      int
+	InterfaceNum   int
+	InterfaceAlt   int
+	OutEndpointNum int
+	InEndpointNum  int
+
+	Source InterfaceSource
+	// Note 使用默认值的原因
+	Note string `json:",omitempty"`
+}
+
+// DeviceDetails 设备详情
+type DeviceDetails struct {
+	DeviceInfo
+	// Profile 匹配到的型号参数，未登记的型号为空
+	Profile   *DeviceProfile
+	Interface InterfaceReport
+}
+
+// selectInterface 按 DeviceOptions 选择扫描接口，AutoDetect 时优先使用描述符中找到的接口
+func selectInterface(desc *gousb.DeviceDesc, opts DeviceOptions) InterfaceReport {
+	report := InterfaceReport{
+		ConfigNum:      opts.ConfigNum,
+		InterfaceNum:   opts.InterfaceNum,
+		InterfaceAlt:   opts.InterfaceAlt,
+		OutEndpointNum: opts.OutEndpointNum,
+		InEndpointNum:  opts.InEndpointNum,
+		Source:         InterfaceFromProfile,
+	}
+	if !opts.AutoDetect {
+		return report
+	}
+
+	found, err := discoverInterface(desc)
+	if err != nil {
+		report.Source = InterfaceFromDefault
+		report.Note = err.Error()
+		return report
+	}
+	return found
+}
+
+/*
+discoverInterface 在描述符中查找扫描接口
+
+Brother 的一体机通常有一个打印机类（0x07）的接口和一个厂商自定义类（0xff）的扫描接口，
+例如 M7206 的扫描接口为 1，bulk OUT 端点 4，bulk IN 端点 5（地址 0x85）。
+
+选择第一个同时具有 bulk IN 和 bulk OUT 端点的厂商自定义接口，端点取编号最小的一对。
+*/
+func discoverInterface(desc *gousb.DeviceDesc) (InterfaceReport, error) {
+	if desc == nil {
+		return InterfaceReport{}, fmt.Errorf("no device descriptor")
+	}
+
+	configs := make([]int, 0, len(desc.Configs))
+	for num := range desc.Configs {
+		configs = append(configs, num)
+	}
+	slices.Sort(configs)
+
+	for _, num := range configs {
+		for _, intf := range desc.Configs[num].Interfaces {
+			for _, alt := range intf.AltSettings {
+				if alt.Class != gousb.ClassVendorSpec {
+					continue
+				}
+				out, in := bulkEndpoints(alt)
+				if out == 0 || in == 0 {
+					continue
+				}
+				return InterfaceReport{
+					ConfigNum:      num,
+					InterfaceNum:   alt.Number,
+					InterfaceAlt:   alt.Alternate,
+					OutEndpointNum: out,
+					InEndpointNum:  in,
+					Source:         InterfaceFromDescriptor,
+				}, nil
+			}
+		}
+	}
+	return InterfaceReport{}, fmt.Errorf("no vendor specific interface with bulk endpoints in %s", desc)
+}
+
+// bulkEndpoints 编号最小的 bulk OUT 和 bulk IN 端点，没有时为 0
+func bulkEndpoints(alt gousb.InterfaceSetting) (out, in int) {
+	for _, ep := range alt.Endpoints {
+		if ep.TransferType != gousb.TransferTypeBulk {
+			continue
+		}
+		if ep.Direction == gousb.EndpointDirectionIn {
+			if in == 0 || ep.Number < in {
+				in = ep.Number
+			}
+		} else if out == 0 || ep.Number < out {
+			out = ep.Number
+		}
+	}
+	return out, in
+}
+
+// apply 使用选中的接口打开设备
+func (report InterfaceReport) apply(opts DeviceOptions) DeviceOptions {
+	opts.ConfigNum = report.ConfigNum
+	opts.InterfaceNum = report.InterfaceNum
+	opts.InterfaceAlt = report.InterfaceAlt
+	opts.OutEndpointNum = report.OutEndpointNum
+	opts.InEndpointNum = report.InEndpointNum
+	return opts
+}
+
+// DescribeDevice 查询设备详情，包括匹配的型号参数和打开设备时将使用的接口，
+// 有序列号的设备需要 info 中带有端口路径
+func DescribeDevice(info DeviceInfo, opts DeviceOptions) (*DeviceDetails, error) {
+	details := &DeviceDetails{DeviceInfo: info}
+	profile, known := LookupProfile(info)
+	if known {
+		details.Profile = &profile
+		opts = profile.apply(opts)
+	}
+
+	if Emulator != nil && info.IsEmulator() {
+		details.DeviceInfo = EmulatorDevice
+		details.Interface = InterfaceReport{Source: InterfaceFromEmulator}
+		return details, nil
+	}
+	// 只有序列号时无法从描述符区分相同型号的设备，调用方应先在设备清单中找到端口路径
+	if info.SerialNumber != "" && info.Path == "" {
+		return nil, fmt.Errorf("device %s not found", info.ID)
+	}
+
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+
+	var desc *gousb.DeviceDesc
+	// 只读取描述符，不打开设备，正在扫描的设备也可以查询，因此只按端口路径区分相同型号
+	_, err := ctx.OpenDevices(func(d *gousb.DeviceDesc) bool {
+		if desc == nil && uint16(d.Vendor) == info.ParseVendorID() && uint16(d.Product) == info.ParseProductID() &&
+			(info.Path == "" || usbPath(d) == info.Path) {
+			desc = d
+		}
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list usb devices: %w", err)
+	}
+	if desc == nil {
+		return nil, fmt.Errorf("device %s not found", info.ID)
+	}
+
+	id := details.ID
+	details.Transfer(desc)
+	details.ID = id
+	details.Interface = selectInterface(desc, opts)
+	return details, nil
+}
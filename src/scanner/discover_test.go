@@ -0,0 +1,14 @@
+package scanner
+
+import "testing"
+
+func TestDescribeDeviceBySerial(t *testing.T) {
+	// 没有端口路径时不能按型号猜测是哪一台
+	info, err := ParseDeviceID("17ef:5629@E123")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if _, err := DescribeDevice(info, DefaultDeviceOptions); err == nil {
+		t.Error("described a device by serial number without its port path")
+	}
+}
@@ -0,0 +1,422 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmulatorDevice 模拟设备在设备列表中的信息，厂商ID 0000 不属于任何真实设备
+var EmulatorDevice = DeviceInfo{
+	ID:           "0000:7206",
+	Name:         "Virtual M7206",
+	VendorID:     "0x0000",
+	ProductID:    "0x7206",
+	Manufacturer: "Emulator",
+	Product:      "M7206",
+	SerialNumber: "EMULATOR",
+}
+
+// Emulator 模拟设备的配置，为 nil 时不启用模拟设备
+var Emulator *EmulatorOptions
+
+// EmulatorOptions 模拟设备的行为
+type EmulatorOptions struct {
+	// Image 每页扫描出的图像，会缩放到请求的扫描区域，为空时使用彩条测试图
+	Image image.Image
+	// Sheets 自动进纸器中的纸张数，平板始终只有一页
+	Sheets int
+	// Delay 每次读取扫描数据前的延迟，用于模拟慢速设备
+	Delay time.Duration
+	// Fault 注入的设备错误，例如 ErrPaperJam
+	Fault error
+	// FaultAfter 在第几张纸之后报告 Fault，为 0 时选择纸张来源就报错
+	FaultAfter int
+	// FaultMidSheet 为 true 时在第 FaultAfter 张纸（从 0 开始）发送了部分数据之后才报告 Fault，模拟扫描中卡纸
+	FaultMidSheet bool
+}
+
+// emulatorMaxWidth/emulatorMaxHeight 模拟设备的最大扫描区域 [mm]
+var (
+	emulatorMaxWidth  = 215.9
+	emulatorMaxHeight = 355.6
+)
+
+// emulatorBlockSize JPEG 数据块的最大长度
+const emulatorBlockSize = 0xfff0
+
+var _ Transport = (*EmulatorTransport)(nil)
+
+// EmulatorTransport 在内存中模拟 M7206 的 Transport，按真实设备的格式响应
+// ESC Q、ESC I、ESC D、ESC X 和 ESC R
+type EmulatorTransport struct {
+	opts EmulatorOptions
+
+	mu      sync.Mutex
+	source  string
+	job     *emulatorJob
+	packets [][]byte
+	// scanning 扫描数据发送完之前每次读取都有 Delay
+	scanning bool
+}
+
+// emulatorJob ESC X 请求的扫描任务，扫描数据在第一次读取时生成
+type emulatorJob struct {
+	dpi         [2]int
+	mode        ScanMode
+	compression Compression
+	width       int
+	height      int
+	duplex      bool
+}
+
+func NewEmulatorTransport(opts EmulatorOptions) *EmulatorTransport {
+	opts.Sheets = max(opts.Sheets, 1)
+	return &EmulatorTransport{opts: opts}
+}
+
+// IsEmulator 设备是否为模拟设备
+func (info *DeviceInfo) IsEmulator() bool {
+	return info.ParseVendorID() == EmulatorDevice.ParseVendorID() &&
+		info.ParseProductID() == EmulatorDevice.ParseProductID()
+}
+
+func (e *EmulatorTransport) Control(ctx context.Context, rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (e *EmulatorTransport) Write(ctx context.Context, p []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) < 3 || p[0] != 0x1b || p[len(p)-1] != 0x80 {
+		return 0, fmt.Errorf("emulator: malformed command % x", p)
+	}
+	params := parseEmulatorParams(p[2 : len(p)-1])
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch p[1] {
+	case 'Q':
+		e.packets = append(e.packets, e.capabilities())
+	case 'I':
+		dpi, _ := parseEmulatorInts(params["R"], 2)
+		e.packets = append(e.packets, emulatorNegotiate(dpi))
+	case 'D':
+		e.source = strings.TrimSpace(string(p[2 : len(p)-1]))
+		if e.opts.Fault != nil && e.opts.FaultAfter == 0 && !e.opts.FaultMidSheet {
+			e.packets = append(e.packets, []byte{emulatorStatus(e.opts.Fault)})
+		} else {
+			e.packets = append(e.packets, []byte{0xd0})
+		}
+	case 'X':
+		dpi, err := parseEmulatorInts(params["R"], 2)
+		if err != nil {
+			return 0, fmt.Errorf("emulator: R=%s: %w", params["R"], err)
+		}
+		area, err := parseEmulatorInts(params["A"], 4)
+		if err != nil {
+			return 0, fmt.Errorf("emulator: A=%s: %w", params["A"], err)
+		}
+		e.packets = nil
+		e.scanning = true
+		e.job = &emulatorJob{
+			dpi:         [2]int{dpi[0], dpi[1]},
+			mode:        ScanMode(params["M"]),
+			compression: Compression(params["C"]),
+			width:       area[2],
+			height:      area[3],
+			duplex:      params["S"] == "DUPLEX_SCAN",
+		}
+	case 'R':
+		e.job = nil
+		e.packets = nil
+		e.scanning = false
+	default:
+		return 0, fmt.Errorf("emulator: unknown command ESC %c", p[1])
+	}
+	return len(p), nil
+}
+
+// Read 没有待发送的数据时返回 0，和真实设备的空数据包一样
+func (e *EmulatorTransport) Read(ctx context.Context, p []byte) (int, error) {
+	e.mu.Lock()
+	scanning := e.scanning
+	e.mu.Unlock()
+
+	if scanning && e.opts.Delay > 0 {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(e.opts.Delay):
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.job != nil && len(e.packets) == 0 {
+		data, err := e.scanData(*e.job)
+		if err != nil {
+			return 0, fmt.Errorf("emulator: %w", err)
+		}
+		e.job = nil
+		e.packets = append(e.packets, data)
+	}
+	if len(e.packets) == 0 {
+		e.scanning = false
+		return 0, nil
+	}
+
+	n := copy(p, e.packets[0])
+	if n < len(e.packets[0]) {
+		e.packets[0] = e.packets[0][n:]
+	} else {
+		e.packets = e.packets[1:]
+	}
+	return n, nil
+}
+
+func (e *EmulatorTransport) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.job = nil
+	e.packets = nil
+	e.scanning = false
+	return nil
+}
+
+// capabilities ESC Q 的响应，格式见 Capabilities
+func (e *EmulatorTransport) capabilities() []byte {
+	resp := []byte{
+		0xc1, 0x00, 0x1c, capabilitySourceFlatbed | capabilitySourceADF | capabilitySourceDuplex, 0xff, 0x03,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x04,
+		0x01, 0x01, 0x01, 0x01, 0x01,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	}
+	binary.LittleEndian.PutUint16(resp[6:8], uint16(emulatorMaxWidth*10))
+	binary.LittleEndian.PutUint16(resp[8:10], uint16(emulatorMaxHeight*10))
+	return resp
+}
+
+// emulatorNegotiate ESC I 的响应，格式见 negotiateScannerSettings
+func emulatorNegotiate(dpi []int) []byte {
+	if len(dpi) < 2 {
+		dpi = []int{300, 300}
+	}
+	body := fmt.Sprintf("%d,%d,2,%d,%d,%d,%d,",
+		dpi[0], dpi[1],
+		int(emulatorMaxWidth), int(emulatorMaxWidth*float64(dpi[0])/25.4),
+		int(emulatorMaxHeight), int(emulatorMaxHeight*float64(dpi[1])/25.4))
+	resp := []byte{0x00, byte(len(body)), 0x00}
+	resp = append(resp, body...)
+	return append(resp, 0x00)
+}
+
+// scanData 生成整个任务的扫描数据，每张纸以 0x80 结束，自动进纸器的纸用完后发送 0x81
+func (e *EmulatorTransport) scanData(job emulatorJob) ([]byte, error) {
+	if job.width <= 0 || job.height <= 0 {
+		return nil, fmt.Errorf("empty scan area %dx%d", job.width, job.height)
+	}
+	sheets := e.opts.Sheets
+	if e.source == ScanSourceFlatbed.command() {
+		sheets = 1
+	}
+
+	var data bytes.Buffer
+	fault := func(sheet int, midSheet bool) bool {
+		if e.opts.Fault == nil || sheet != e.opts.FaultAfter || e.opts.FaultMidSheet != midSheet {
+			return false
+		}
+		data.Write([]byte{statusPrefix, 'R', emulatorStatus(e.opts.Fault)})
+		return true
+	}
+	for sheet := range sheets {
+		if fault(sheet, false) {
+			return data.Bytes(), nil
+		}
+
+		front := e.page(job)
+		if job.compression == CompressionRLENGTH {
+			if err := writeEmulatorLines(&data, front, job.mode.PixelFormat()); err != nil {
+				return nil, err
+			}
+			if fault(sheet, true) {
+				return data.Bytes(), nil
+			}
+			data.WriteByte(endOfPage)
+			continue
+		}
+
+		// 双面扫描时正面为奇数页，背面为偶数页，两面的数据块交替发送
+		var sides [][]byte
+		pageNumbers := []int{sheet + 1}
+		if job.duplex {
+			pageNumbers = []int{sheet*2 + 1, sheet*2 + 2}
+		}
+		for i := range pageNumbers {
+			img := front
+			if i == 1 {
+				img = rotate180(front)
+			}
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+				return nil, err
+			}
+			sides = append(sides, buf.Bytes())
+		}
+		for len(sides[0]) > 0 || len(sides[len(sides)-1]) > 0 {
+			for i, side := range sides {
+				n := min(len(side), emulatorBlockSize)
+				if n == 0 {
+					continue
+				}
+				header := make([]byte, 12)
+				header[0], header[1] = frameJPEG, 0x07
+				binary.LittleEndian.PutUint16(header[3:5], uint16(pageNumbers[i]))
+				binary.LittleEndian.PutUint16(header[10:12], uint16(n))
+				data.Write(header)
+				data.Write(side[:n])
+				sides[i] = side[n:]
+			}
+			if fault(sheet, true) {
+				return data.Bytes(), nil
+			}
+		}
+		data.WriteByte(endOfPage)
+	}
+	if e.source != ScanSourceFlatbed.command() {
+		data.WriteByte(endOfJob)
+	}
+	return data.Bytes(), nil
+}
+
+// page 按扫描区域缩放测试图像
+func (e *EmulatorTransport) page(job emulatorJob) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, job.width, job.height))
+	src := e.opts.Image
+	for y := range job.height {
+		for x := range job.width {
+			if src == nil {
+				img.Set(x, y, testPattern(x, y, job.width, job.height))
+				continue
+			}
+			b := src.Bounds()
+			img.Set(x, y, src.At(b.Min.X+x*b.Dx()/job.width, b.Min.Y+y*b.Dy()/job.height))
+		}
+	}
+	return img
+}
+
+var testPatternColors = [...]color.RGBA{
+	{0xff, 0xff, 0xff, 0xff}, {0xff, 0xff, 0x00, 0xff}, {0x00, 0xff, 0xff, 0xff}, {0x00, 0xff, 0x00, 0xff},
+	{0xff, 0x00, 0xff, 0xff}, {0xff, 0x00, 0x00, 0xff}, {0x00, 0x00, 0xff, 0xff}, {0x00, 0x00, 0x00, 0xff},
+}
+
+// testPattern 上部为彩条，下部为灰度渐变
+func testPattern(x, y, width, height int) color.Color {
+	if y < height*3/4 {
+		return testPatternColors[x*len(testPatternColors)/width]
+	}
+	return color.Gray{Y: uint8(x * 255 / max(width-1, 1))}
+}
+
+// writeEmulatorLines 按 RLENGTH 格式逐行输出，格式见 DecodeRLENGTH
+func writeEmulatorLines(data *bytes.Buffer, img image.Image, format PixelFormat) error {
+	bounds := img.Bounds()
+	line := func(kind byte, row []byte) {
+		data.WriteByte(kind)
+		binary.Write(data, binary.LittleEndian, uint16(len(row)))
+		data.Write(row)
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		switch format {
+		case PixelFormatMono:
+			row := make([]byte, (bounds.Dx()+7)/8)
+			for x := range bounds.Dx() {
+				if color.GrayModel.Convert(img.At(bounds.Min.X+x, y)).(color.Gray).Y < 0x80 {
+					row[x/8] |= 0x80 >> (x % 8)
+				}
+			}
+			line(rasterLineGray, row)
+		case PixelFormatGray:
+			row := make([]byte, bounds.Dx())
+			for x := range row {
+				row[x] = color.GrayModel.Convert(img.At(bounds.Min.X+x, y)).(color.Gray).Y
+			}
+			line(rasterLineGray, row)
+		case PixelFormatIndexed:
+			row := make([]byte, bounds.Dx())
+			for x := range row {
+				c := color.RGBAModel.Convert(img.At(bounds.Min.X+x, y)).(color.RGBA)
+				row[x] = c.R&0xe0 | c.G>>5<<2 | c.B>>6
+			}
+			line(rasterLineGray, row)
+		case PixelFormatRGB:
+			var planes [3][]byte
+			for x := range bounds.Dx() {
+				c := color.RGBAModel.Convert(img.At(bounds.Min.X+x, y)).(color.RGBA)
+				planes[0] = append(planes[0], c.R)
+				planes[1] = append(planes[1], c.G)
+				planes[2] = append(planes[2], c.B)
+			}
+			line(rasterLineRed, planes[0])
+			line(rasterLineGreen, planes[1])
+			line(rasterLineBlue, planes[2])
+		default:
+			return fmt.Errorf("unsupported pixel format %q", format)
+		}
+	}
+	return nil
+}
+
+// emulatorStatus 错误对应的设备状态字节
+func emulatorStatus(fault error) byte {
+	for status, err := range deviceStatus {
+		if err == fault {
+			return status
+		}
+	}
+	return 0xc5
+}
+
+// parseEmulatorParams 解析命令中换行分隔的 KEY=VALUE 参数
+func parseEmulatorParams(body []byte) map[string]string {
+	params := map[string]string{}
+	for _, field := range strings.Split(string(body), "\n") {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			params[key] = value
+		}
+	}
+	return params
+}
+
+func parseEmulatorInts(value string, n int) ([]int, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != n {
+		return nil, fmt.Errorf("expected %d values", n)
+	}
+	ints := make([]int, n)
+	for i, field := range fields {
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		ints[i] = v
+	}
+	return ints, nil
+}
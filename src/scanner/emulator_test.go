@@ -0,0 +1,192 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"slices"
+	"testing"
+)
+
+// commandLog 记录发送给模拟设备的命令
+type commandLog struct {
+	*EmulatorTransport
+	commands []string
+}
+
+func (c *commandLog) Write(ctx context.Context, p []byte) (int, error) {
+	c.commands = append(c.commands, string(p))
+	return c.EmulatorTransport.Write(ctx, p)
+}
+
+func newEmulatorScanner(t *testing.T, opts EmulatorOptions) (*CommonScanner, *commandLog) {
+	t.Helper()
+	log := &commandLog{EmulatorTransport: NewEmulatorTransport(opts)}
+	scanner := NewTransportScanner(EmulatorDevice, func() (Transport, error) {
+		return log, nil
+	}, DefaultDeviceOptions)
+	if err := scanner.Connect(context.Background()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { scanner.Disconnect() })
+	return scanner, log
+}
+
+// smallScan 低分辨率的小扫描区域，测试时生成的图像很小
+func smallScan(source ScanSource, mode ScanMode) ScanOptions {
+	opts := DefaultScanOptions
+	opts.DPI = 75
+	opts.Mode = mode
+	opts.Source = source
+	opts.Width, opts.Height = 50, 40
+	return opts
+}
+
+func TestEmulatorScanPages(t *testing.T) {
+	tests := []struct {
+		name   string
+		sheets int
+		opts   ScanOptions
+		pages  int
+		format ImageFormat
+	}{
+		{"flatbed", 3, smallScan(ScanSourceFlatbed, ScanModeCGRAY), 1, ImageFormatJPEG},
+		{"adf", 3, smallScan(ScanSourceADF, ScanModeCGRAY), 3, ImageFormatJPEG},
+		{"duplex", 2, smallScan(ScanSourceADFDuplex, ScanModeCGRAY), 4, ImageFormatJPEG},
+		{"rlength gray", 1, smallScan(ScanSourceADF, ScanModeTrueGray), 1, ImageFormatJPEG},
+		{"rlength text", 2, smallScan(ScanSourceFlatbed, ScanModeText), 1, ImageFormatPNG},
+	}
+	tests[3].opts.Compression = CompressionRLENGTH
+	tests[3].opts.Format = ImageFormatJPEG
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner, _ := newEmulatorScanner(t, EmulatorOptions{Sheets: tt.sheets})
+			var stages []Stage
+			ctx := WithProgress(context.Background(), func(p Progress) {
+				if len(stages) == 0 || stages[len(stages)-1] != p.Stage {
+					stages = append(stages, p.Stage)
+				}
+			})
+
+			pages, err := scanner.ScanPages(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			if len(pages) != tt.pages {
+				t.Fatalf("%d pages, want %d", len(pages), tt.pages)
+			}
+			for i, page := range pages {
+				if page.Index != i || page.Format != tt.format {
+					t.Errorf("page %d: index %d, format %s, want format %s", i, page.Index, page.Format, tt.format)
+				}
+				decode := jpeg.Decode
+				if tt.format == ImageFormatPNG {
+					decode = png.Decode
+				}
+				img, err := decode(bytes.NewReader(page.Data))
+				if err != nil {
+					t.Fatalf("page %d: decode: %v", i, err)
+				}
+				if bounds := img.Bounds(); bounds.Dx() < 100 || bounds.Dy() < 80 {
+					t.Errorf("page %d: size %v, want about 147x118", i, bounds)
+				}
+			}
+			if stages[len(stages)-1] != StageDone || !slices.Contains(stages, StagePageComplete) {
+				t.Errorf("stages %v, want page complete and done", stages)
+			}
+		})
+	}
+}
+
+func TestEmulatorProgressThrottled(t *testing.T) {
+	scanner, _ := newEmulatorScanner(t, EmulatorOptions{Sheets: 1})
+	var percents []int
+	ctx := WithProgress(context.Background(), func(p Progress) {
+		if p.Stage == StageScanning {
+			percents = append(percents, p.Percent)
+		}
+	})
+	opts := smallScan(ScanSourceFlatbed, ScanModeCGRAY)
+	opts.DPI = 300
+	if _, err := scanner.ScanPages(ctx, opts); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	// 第一次报告在开始接收数据时，之后只在百分比变化时报告
+	if len(percents) < 3 {
+		t.Fatalf("scanning reported %v, want progress while receiving", percents)
+	}
+	for i := 2; i < len(percents); i++ {
+		if percents[i] == percents[i-1] {
+			t.Fatalf("scanning reported %v, repeated %d%%", percents, percents[i])
+		}
+	}
+}
+
+func TestEmulatorDuplexBackSide(t *testing.T) {
+	scanner, _ := newEmulatorScanner(t, EmulatorOptions{Sheets: 1})
+	pages, err := scanner.ScanPages(context.Background(), smallScan(ScanSourceADFDuplex, ScanModeCGRAY))
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("%d pages, want 2", len(pages))
+	}
+	if bytes.Contains(pages[0].Data, []byte("Exif")) {
+		t.Error("front side has an orientation mark")
+	}
+	if !bytes.Contains(pages[1].Data, []byte("Exif")) {
+		t.Error("back side has no orientation mark")
+	}
+}
+
+func TestEmulatorScanStopsADF(t *testing.T) {
+	scanner, log := newEmulatorScanner(t, EmulatorOptions{Sheets: 3})
+
+	var out bytes.Buffer
+	if err := scanner.Scan(context.Background(), &out, smallScan(ScanSourceADF, ScanModeCGRAY)); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if _, _, err := image.Decode(&out); err != nil {
+		t.Errorf("decode page: %v", err)
+	}
+	if last := log.commands[len(log.commands)-1]; last != "\x1bR\n\x80" {
+		t.Errorf("last command %q, want ESC R", last)
+	}
+}
+
+func TestEmulatorFault(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  EmulatorOptions
+		pages int
+	}{
+		{"select source", EmulatorOptions{Sheets: 2, Fault: ErrNoPaper}, 0},
+		{"second sheet", EmulatorOptions{Sheets: 3, Fault: ErrPaperJam, FaultAfter: 1}, 1},
+		{"mid sheet", EmulatorOptions{Sheets: 3, Fault: ErrPaperJam, FaultAfter: 1, FaultMidSheet: true}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner, _ := newEmulatorScanner(t, tt.opts)
+			var errs []error
+			ctx := WithProgress(context.Background(), func(p Progress) {
+				if p.Stage == StageError {
+					errs = append(errs, p.Err)
+				}
+			})
+			_, err := scanner.ScanPages(ctx, smallScan(ScanSourceADF, ScanModeCGRAY))
+			if !errors.Is(err, tt.opts.Fault) {
+				t.Fatalf("error %v, want %v", err, tt.opts.Fault)
+			}
+			if len(errs) != 1 || !errors.Is(errs[0], tt.opts.Fault) {
+				t.Errorf("reported errors %v, want %v", errs, tt.opts.Fault)
+			}
+			if scanner.progress.Pages != tt.pages {
+				t.Errorf("%d pages completed, want %d", scanner.progress.Pages, tt.pages)
+			}
+		})
+	}
+}
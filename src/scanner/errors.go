@@ -0,0 +1,85 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 设备上报的错误，可以用 errors.Is 判断
+var (
+	ErrNoPaper    = errors.New("no paper")
+	ErrPaperJam   = errors.New("paper jam")
+	ErrCoverOpen  = errors.New("cover open")
+	ErrDeviceBusy = errors.New("device busy")
+	// ErrTimeout 设备在 TimingPolicy 规定的时间内没有响应
+	ErrTimeout = errors.New("device timeout")
+	// ErrDeviceGone 设备在使用过程中被拔出或断电
+	ErrDeviceGone = errors.New("device disconnected")
+)
+
+// 打开设备失败的原因，见 OpenHint
+var (
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrDeviceInUse      = errors.New("device in use")
+	ErrDeviceNotFound   = errors.New("device not found")
+)
+
+// OpenHint 打开设备失败时的处理建议，未归类的错误返回空字符串
+func OpenHint(err error, info DeviceInfo) string {
+	switch {
+	case errors.Is(err, ErrPermissionDenied):
+		return fmt.Sprintf("当前用户没有权限访问USB设备，请以 root 运行，或安装 udev 规则后重新插拔设备："+
+			"echo 'SUBSYSTEM==\"usb\", ATTR{idVendor}==\"%04x\", ATTR{idProduct}==\"%04x\", MODE=\"0666\"' | "+
+			"sudo tee /etc/udev/rules.d/60-scanner.rules && sudo udevadm control --reload-rules",
+			info.ParseVendorID(), info.ParseProductID())
+	case errors.Is(err, ErrDeviceInUse):
+		return "设备正被其他程序占用，请关闭 SANE（scanimage、simple-scan）、CUPS 等可能使用该扫描仪的程序，或等待其他扫描任务完成后重试"
+	case errors.Is(err, ErrDeviceNotFound):
+		return "没有找到设备，请检查扫描仪电源和USB连接，并刷新设备列表"
+	default:
+		return ""
+	}
+}
+
+/*
+The device reports problems with a single status byte instead of the
+expected response, or while scanning with ESC R followed by the status.
+Neither form is in the M7206 capture: the two shapes below and the byte
+values in deviceStatus are unverified guesses and have not been checked
+against a device reporting a real jam, open cover or empty feeder:
+
+	c2          status byte in place of a response
+	1b 52 c3    ESC R and the status byte between data blocks
+*/
+const statusPrefix = 0x1b
+
+var deviceStatus = map[byte]error{
+	0xc2: ErrNoPaper,
+	0xc3: ErrPaperJam,
+	0xc4: ErrCoverOpen,
+	0xc5: ErrDeviceBusy,
+}
+
+// isStatus 数据块边界上的字节是否为状态响应
+func isStatus(b byte) bool {
+	_, ok := deviceStatus[b]
+	return ok || b == statusPrefix
+}
+
+// checkStatus 将设备的状态响应转换为错误，普通响应返回 nil
+func checkStatus(resp []byte) error {
+	switch {
+	case len(resp) >= 2 && resp[0] == statusPrefix && resp[1] == 'R':
+		if len(resp) < 3 {
+			return fmt.Errorf("device reported an error")
+		}
+		if err, ok := deviceStatus[resp[2]]; ok {
+			return err
+		}
+		return fmt.Errorf("device reported error 0x%02x", resp[2])
+	case len(resp) == 1:
+		return deviceStatus[resp[0]]
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,97 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/gousb"
+)
+
+func TestClassifyUSBError(t *testing.T) {
+	info := DeviceInfo{VendorID: "0x17ef", ProductID: "0x5629"}
+	tests := []struct {
+		name   string
+		err    error
+		target error
+		hint   string
+	}{
+		{"access", gousb.ErrorAccess, ErrPermissionDenied, `ATTR{idVendor}=="17ef", ATTR{idProduct}=="5629"`},
+		{"wrapped access", fmt.Errorf("claim usb device interface 1: %w", gousb.ErrorAccess), ErrPermissionDenied, "udev"},
+		{"busy", gousb.ErrorBusy, ErrDeviceInUse, "SANE"},
+		{"not found", gousb.ErrorNotFound, ErrDeviceNotFound, "USB连接"},
+		{"no device", gousb.ErrorNoDevice, ErrDeviceNotFound, "USB连接"},
+		{"already classified", fmt.Errorf("%w: %s", ErrDeviceNotFound, "17ef:5629"), ErrDeviceNotFound, "USB连接"},
+		{"other", gousb.ErrorIO, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyUSBError(tt.err)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("error %v lost the libusb error %v", err, tt.err)
+			}
+			for _, target := range []error{ErrPermissionDenied, ErrDeviceInUse, ErrDeviceNotFound} {
+				if errors.Is(err, target) != (target == tt.target) {
+					t.Errorf("errors.Is(%v, %v) = %v", err, target, target != tt.target)
+				}
+			}
+			hint := OpenHint(err, info)
+			if (hint == "") != (tt.hint == "") || !strings.Contains(hint, tt.hint) {
+				t.Errorf("hint %q, want it to contain %q", hint, tt.hint)
+			}
+		})
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    []byte
+		target  error
+		wantErr bool
+	}{
+		{name: "no paper", resp: []byte{0xc2}, target: ErrNoPaper},
+		{name: "busy", resp: []byte{0xc5}, target: ErrDeviceBusy},
+		{name: "esc r jam", resp: []byte{0x1b, 'R', 0xc3}, target: ErrPaperJam},
+		{name: "esc r cover", resp: []byte{0x1b, 'R', 0xc4, 0x00}, target: ErrCoverOpen},
+		{name: "esc r unknown", resp: []byte{0x1b, 'R', 0x99}, wantErr: true},
+		{name: "esc r truncated", resp: []byte{0x1b, 'R'}, wantErr: true},
+		{name: "unknown byte", resp: []byte{0x80}},
+		// 以状态字节开头的普通响应
+		{name: "data", resp: []byte{0xc3, 0x00, 0x1c}},
+		{name: "capabilities", resp: m7206Capabilities},
+		{name: "empty", resp: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStatus(tt.resp)
+			switch {
+			case tt.target != nil && !errors.Is(err, tt.target):
+				t.Errorf("error %v, want %v", err, tt.target)
+			case tt.target == nil && tt.wantErr != (err != nil):
+				t.Errorf("error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsStatus(t *testing.T) {
+	tests := []struct {
+		b    byte
+		want bool
+	}{
+		{0xc2, true},
+		{0xc5, true},
+		{statusPrefix, true},
+		{frameJPEG, false},
+		{framePreamble, false},
+		{0x80, false},
+		{0xc6, false},
+	}
+	for _, tt := range tests {
+		if got := isStatus(tt.b); got != tt.want {
+			t.Errorf("isStatus(0x%02x) = %v, want %v", tt.b, got, tt.want)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package scanner
 
+import "fmt"
+
 var DefaultScanOptions = ScanOptions{
 	DPI:    400,
 	Mode:   ScanModeCGRAY,
+	Source: ScanSourceADF,
 	Top:    0,
 	Left:   0,
 	Width:  211.881,
@@ -12,10 +15,92 @@ var DefaultScanOptions = ScanOptions{
 type ScanOptions struct {
 	DPI  uint16
 	Mode ScanMode
-	// TODO: Compression string, currently JPEG
+	// 为空时使用自动进纸器
+	Source ScanSource
+	// 为空时黑白模式使用 RLENGTH，其他模式使用 JPEG
+	Compression Compression
+	// 输出文件格式，JPEG 压缩时只能为 JPEG，RLENGTH 为空时默认 PNG
+	Format ImageFormat
+	// 亮度和对比度，相对设备默认值的偏移，范围 -50 到 50，0 为默认
+	Brightness int
+	Contrast   int
 	// All in [mm]
 	Top    float64
 	Left   float64
 	Width  float64
 	Height float64
 }
+
+// Validate 在发送给设备之前检查扫描参数
+func (opts ScanOptions) Validate() error {
+	if err := opts.Mode.Validate(); err != nil {
+		return err
+	}
+	if err := opts.source().Validate(); err != nil {
+		return err
+	}
+	if opts.source() == ScanSourceADFDuplex && opts.compression() != CompressionJPEG {
+		return fmt.Errorf("duplex scans are only supported with JPEG compression")
+	}
+	switch opts.compression() {
+	case CompressionJPEG:
+		if opts.Mode.PixelFormat() == PixelFormatMono {
+			return fmt.Errorf("scan mode %s does not support JPEG compression", opts.Mode)
+		}
+		if opts.Format != "" && opts.Format != ImageFormatJPEG {
+			return fmt.Errorf("JPEG compression can only be written as JPEG, got %s", opts.Format)
+		}
+	case CompressionRLENGTH:
+		switch opts.OutputFormat() {
+		case ImageFormatJPEG, ImageFormatPNG, ImageFormatTIFF:
+		default:
+			return fmt.Errorf("unsupported image format %q", opts.Format)
+		}
+	default:
+		return fmt.Errorf("unsupported compression %q", opts.Compression)
+	}
+	if opts.Brightness < -50 || opts.Brightness > 50 {
+		return fmt.Errorf("brightness must be between -50 and 50, got %d", opts.Brightness)
+	}
+	if opts.Contrast < -50 || opts.Contrast > 50 {
+		return fmt.Errorf("contrast must be between -50 and 50, got %d", opts.Contrast)
+	}
+	if opts.DPI == 0 {
+		return fmt.Errorf("DPI must be positive")
+	}
+	if opts.Width <= 0 || opts.Height <= 0 {
+		return fmt.Errorf("scan area must be positive, got %gx%gmm", opts.Width, opts.Height)
+	}
+	if opts.Top < 0 || opts.Left < 0 {
+		return fmt.Errorf("scan offset must not be negative, got %g,%gmm", opts.Left, opts.Top)
+	}
+	return nil
+}
+
+func (opts ScanOptions) source() ScanSource {
+	if opts.Source != "" {
+		return opts.Source
+	}
+	return ScanSourceADF
+}
+
+func (opts ScanOptions) compression() Compression {
+	if opts.Compression != "" {
+		return opts.Compression
+	}
+	if opts.Mode.PixelFormat() == PixelFormatMono {
+		return CompressionRLENGTH
+	}
+	return CompressionJPEG
+}
+
+// OutputFormat 扫描结果的文件格式
+func (opts ScanOptions) OutputFormat() ImageFormat {
+	if opts.Format != "" {
+		return opts.Format
+	}
+	if opts.compression() == CompressionRLENGTH {
+		return ImageFormatPNG
+	}
+	return ImageFormatJPEG
+}
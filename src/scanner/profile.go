@@ -0,0 +1,187 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DeviceProfile 某个型号的USB参数、能力和协议差异，按 VendorID:ProductID 匹配
+type DeviceProfile struct {
+	// ID 格式同 lsusb，例如：17ef:5629
+	ID   string
+	Name string
+
+	ConfigNum      int
+	InterfaceNum   int
+	InterfaceAlt   int
+	OutEndpointNum int
+	InEndpointNum  int
+
+	// 覆盖 ESC Q 上报的能力，为空时使用设备上报的值
+	Resolutions []uint16
+	Modes       []ScanMode
+	Sources     []ScanSource
+	// MaxResolution 最高分辨率，设备上报的更高分辨率会被去掉，为 0 时不限制
+	MaxResolution uint16
+
+	// JPEGHeaderSize JPEG 数据块头的长度，为 0 时使用 12，见 frameHeader
+	JPEGHeaderSize int
+}
+
+// DefaultProfile 未登记的设备使用的参数
+var DefaultProfile = DeviceProfile{
+	ConfigNum:      DefaultDeviceOptions.ConfigNum,
+	InterfaceNum:   DefaultDeviceOptions.InterfaceNum,
+	InterfaceAlt:   DefaultDeviceOptions.InterfaceAlt,
+	OutEndpointNum: DefaultDeviceOptions.OutEndpointNum,
+	InEndpointNum:  DefaultDeviceOptions.InEndpointNum,
+	// ESC Q 的解析只对照过 M7206，它上报到 19200 dpi，光学分辨率为 1200 dpi
+	MaxResolution: 1200,
+}
+
+var (
+	profilesMu sync.RWMutex
+	profiles   = map[string]DeviceProfile{}
+)
+
+// 只登记有抓包验证过的型号，兄弟的型号没有抓包，未登记时从描述符中查找接口，
+// 或者通过 LoadProfiles 登记
+func init() {
+	m7206 := DefaultProfile
+	m7206.ID = "17ef:5629"
+	m7206.Name = "Lenovo M7206"
+	RegisterProfile(m7206)
+}
+
+// RegisterProfile 登记设备参数，ID 相同时替换已有的参数
+func RegisterProfile(profile DeviceProfile) error {
+	key, err := profileKey(profile.ID)
+	if err != nil {
+		return err
+	}
+	for _, mode := range profile.Modes {
+		if err := mode.Validate(); err != nil {
+			return fmt.Errorf("profile %s: %w", profile.ID, err)
+		}
+	}
+	for _, source := range profile.Sources {
+		if err := source.Validate(); err != nil {
+			return fmt.Errorf("profile %s: %w", profile.ID, err)
+		}
+	}
+	if profile.JPEGHeaderSize != 0 && profile.JPEGHeaderSize < 7 {
+		return fmt.Errorf("profile %s: JPEG header of %d bytes is too short", profile.ID, profile.JPEGHeaderSize)
+	}
+
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	profiles[key] = profile
+	return nil
+}
+
+// LoadProfiles 从 JSON 文件加载用户定义的设备参数，文件内容为 DeviceProfile 数组，
+// 未填写的USB参数使用 DefaultProfile 中的值
+func LoadProfiles(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, entry := range raw {
+		profile := DefaultProfile
+		if err := json.Unmarshal(entry, &profile); err != nil {
+			return fmt.Errorf("parse %s: profile %d: %w", path, i, err)
+		}
+		if err := RegisterProfile(profile); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// LookupProfile 查找设备的参数，未登记的设备返回 DefaultProfile，打开设备时从描述符中查找接口
+func LookupProfile(usb DeviceInfo) (DeviceProfile, bool) {
+	key := fmt.Sprintf("%04x:%04x", usb.ParseVendorID(), usb.ParseProductID())
+
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	if profile, ok := profiles[key]; ok {
+		return profile, true
+	}
+	return DefaultProfile, false
+}
+
+// Profiles 所有已登记的设备参数
+func Profiles() []DeviceProfile {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	list := make([]DeviceProfile, 0, len(profiles))
+	for _, profile := range profiles {
+		list = append(list, profile)
+	}
+	slices.SortFunc(list, func(a, b DeviceProfile) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return list
+}
+
+func profileKey(id string) (string, error) {
+	info, err := ParseDeviceID(id)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04x:%04x", info.ParseVendorID(), info.ParseProductID()), nil
+}
+
+// apply 使用型号对应的USB参数，不再从描述符中查找。调用方明确设置的参数（和 DefaultDeviceOptions
+// 不同的值）优先于型号参数，超时等服务配置保持不变
+func (profile DeviceProfile) apply(opts DeviceOptions) DeviceOptions {
+	def := DefaultDeviceOptions
+	use := func(field *int, defValue, profileValue int) {
+		if *field == defValue {
+			*field = profileValue
+		}
+	}
+	opts.AutoDetect = false
+	use(&opts.ConfigNum, def.ConfigNum, profile.ConfigNum)
+	use(&opts.InterfaceNum, def.InterfaceNum, profile.InterfaceNum)
+	use(&opts.InterfaceAlt, def.InterfaceAlt, profile.InterfaceAlt)
+	use(&opts.OutEndpointNum, def.OutEndpointNum, profile.OutEndpointNum)
+	use(&opts.InEndpointNum, def.InEndpointNum, profile.InEndpointNum)
+	return opts
+}
+
+// applyCapabilities 用型号参数覆盖设备上报的能力
+func (profile DeviceProfile) applyCapabilities(caps *Capabilities) {
+	if len(profile.Resolutions) > 0 {
+		caps.Resolutions = slices.Clone(profile.Resolutions)
+	}
+	if profile.MaxResolution > 0 {
+		caps.Resolutions = slices.DeleteFunc(caps.Resolutions, func(dpi uint16) bool {
+			return dpi > profile.MaxResolution
+		})
+	}
+	if len(profile.Modes) > 0 {
+		caps.Modes = slices.Clone(profile.Modes)
+	}
+	if len(profile.Sources) > 0 {
+		caps.Flatbed = slices.Contains(profile.Sources, ScanSourceFlatbed)
+		caps.ADF = slices.Contains(profile.Sources, ScanSourceADF)
+		caps.Duplex = slices.Contains(profile.Sources, ScanSourceADFDuplex)
+	}
+}
+
+func (profile DeviceProfile) jpegHeaderSize() int {
+	if profile.JPEGHeaderSize == 0 {
+		return 12
+	}
+	return profile.JPEGHeaderSize
+}
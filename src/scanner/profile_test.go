@@ -0,0 +1,38 @@
+package scanner
+
+import "testing"
+
+func TestProfileApply(t *testing.T) {
+	profile := DefaultProfile
+	profile.InterfaceNum = 2
+	profile.OutEndpointNum = 3
+	profile.InEndpointNum = 4
+
+	tests := []struct {
+		name string
+		opts func(opts *DeviceOptions)
+		want [3]int
+	}{
+		{"defaults use the profile", func(opts *DeviceOptions) {}, [3]int{2, 3, 4}},
+		{"caller interface wins", func(opts *DeviceOptions) { opts.InterfaceNum = 0 }, [3]int{0, 3, 4}},
+		{"caller endpoints win", func(opts *DeviceOptions) { opts.OutEndpointNum, opts.InEndpointNum = 6, 7 }, [3]int{2, 6, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultDeviceOptions
+			opts.RecordDir = "records"
+			tt.opts(&opts)
+
+			got := profile.apply(opts)
+			if have := [3]int{got.InterfaceNum, got.OutEndpointNum, got.InEndpointNum}; have != tt.want {
+				t.Errorf("interface/out/in %v, want %v", have, tt.want)
+			}
+			if got.AutoDetect {
+				t.Error("a known profile should not search the descriptors")
+			}
+			if got.RecordDir != "records" || got.Timing != opts.Timing {
+				t.Error("service options changed")
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package scanner
+
+import "context"
+
+// Stage 扫描进度的阶段
+type Stage string
+
+const (
+	StageConnecting   Stage = "CONNECTING"    // 打开设备
+	StageNegotiating  Stage = "NEGOTIATING"   // 协商扫描参数
+	StageScanning     Stage = "SCANNING"      // 接收扫描数据
+	StagePageComplete Stage = "PAGE_COMPLETE" // 一页扫描完成
+	StageDone         Stage = "DONE"          // 扫描任务完成
+	StageError        Stage = "ERROR"         // 连接或扫描失败，Err 为失败原因
+)
+
+// jpegCompressionRatio 估算 JPEG 数据量时假设的压缩比
+const jpegCompressionRatio = 10
+
+// Progress 扫描进度
+type Progress struct {
+	Stage Stage
+	// Page 正在扫描的页，从 0 开始
+	Page int
+	// Pages 已完成的页数
+	Pages int
+	// Received 本次扫描已收到的数据字节数
+	Received int64
+	// Percent 当前页的估计进度，0 到 100
+	Percent int
+	Err     error
+}
+
+type progressKey struct{}
+
+// WithProgress 使用返回的上下文连接设备和扫描时，每个阶段开始、当前页的进度变化和每完成一页时
+// 在扫描协程中调用 fn，fn 不应阻塞
+func WithProgress(ctx context.Context, fn func(Progress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func (scanner *CommonScanner) report(ctx context.Context, stage Stage) {
+	scanner.progress.Stage = stage
+	if fn, ok := ctx.Value(progressKey{}).(func(Progress)); ok {
+		fn(scanner.progress)
+	}
+}
+
+// reportError 报告失败，err 为 nil 时不报告
+func (scanner *CommonScanner) reportError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	scanner.progress.Err = err
+	scanner.report(ctx, StageError)
+}
+
+/*
+pageEstimate 估算当前页的进度
+
+RLENGTH 数据每个块为一行，按收到的行数和 negotiateResponse 中的输出高度计算；
+JPEG 数据无法得知压缩后的大小，按未压缩大小的 1/jpegCompressionRatio 估算，页结束前最多为 99%。
+双面扫描时两面的数据交替发送，按两倍的数据量估算。
+*/
+type pageEstimate struct {
+	jpeg     bool
+	lines    int
+	height   int
+	received int64
+	expected int64
+}
+
+func newPageEstimate(request scanRequest, neg *negotiateResponse, format PixelFormat) pageEstimate {
+	width, height := int64(request.width), int64(request.height)
+	if neg.outWidth > 0 {
+		width = min(width, int64(neg.outWidth))
+	}
+	if neg.outHeight > 0 {
+		height = min(height, int64(neg.outHeight))
+	}
+
+	estimate := pageEstimate{
+		jpeg:   request.compression == CompressionJPEG,
+		height: int(height),
+	}
+	bytesPerPixel := int64(max(format.BitsPerPixel(), 8) / 8)
+	estimate.expected = width * height * bytesPerPixel / jpegCompressionRatio
+	if request.duplex {
+		estimate.expected *= 2
+	}
+	return estimate
+}
+
+// receive 收到 n 字节扫描数据
+func (e *pageEstimate) receive(n int) {
+	e.received += int64(n)
+}
+
+// line 收到一行 RLENGTH 数据
+func (e *pageEstimate) line() {
+	e.lines++
+}
+
+func (e *pageEstimate) percent() int {
+	var percent int
+	switch {
+	case e.jpeg && e.expected > 0:
+		percent = int(e.received * 100 / e.expected)
+	case !e.jpeg && e.height > 0:
+		percent = e.lines * 100 / e.height
+	}
+	return min(percent, 99)
+}
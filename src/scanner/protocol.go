@@ -1,23 +1,45 @@
 package scanner
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"time"
+
+	"github.com/google/gousb"
 )
 
 var _ Scanner = (*CommonScanner)(nil)
-var (
-	ResponseTimeoutIt   = 100
-	WaitBetweenRequests = 30 * time.Millisecond
+
+const abortTimeout = 2 * time.Second
+
+// 扫描数据中单独发送的结束标记
+const (
+	endOfPage = 0x80
+	endOfJob  = 0x81
 )
 
+// Page 批量扫描中的一页
+type Page struct {
+	Index  int
+	Format ImageFormat
+	Data   []byte
+}
+
 // Scanner 抽象一个扫描仪设备
 type Scanner interface {
 	// Connect 连接一个设备
-	Connect() error
+	Connect(ctx context.Context) error
+	// Capabilities 查询设备能力
+	Capabilities(ctx context.Context) (*Capabilities, error)
 	// Scan 开始扫描
-	Scan(out io.Writer, opts ScanOptions) error
+	Scan(ctx context.Context, out io.Writer, opts ScanOptions) error
+	// ScanPages 批量扫描，每张纸一页
+	ScanPages(ctx context.Context, opts ScanOptions) ([]Page, error)
 	// Close 断开扫描仪
 	Disconnect() error
 }
@@ -27,87 +49,334 @@ type CommonScanner struct {
 	usb  DeviceInfo
 	opts DeviceOptions
 
-	state *DeviceState
+	profile   DeviceProfile
+	dial      func() (Transport, error)
+	transport Transport
+	caps      *Capabilities
+
+	progress Progress
+	estimate pageEstimate
 }
 
+// NewCommonScanner 按设备ID匹配型号参数，已登记的型号使用其USB接口和端点，
+// 其他型号在打开设备时从描述符中查找
 func NewCommonScanner(usb DeviceInfo, opts DeviceOptions) *CommonScanner {
+	profile, known := LookupProfile(usb)
+	if known {
+		opts = profile.apply(opts)
+	}
+	opts.Timing = opts.Timing.withDefaults()
+	return &CommonScanner{
+		usb:     usb,
+		opts:    opts,
+		profile: profile,
+		dial: func() (Transport, error) {
+			if Emulator != nil && usb.IsEmulator() {
+				return NewEmulatorTransport(*Emulator), nil
+			}
+			state, err := open(usb, opts)
+			if err != nil {
+				return nil, fmt.Errorf("open device %s: %w", usb.ID, err)
+			}
+			return state, nil
+		},
+	}
+}
+
+// NewTransportScanner 使用 dial 创建的传输层代替USB设备，每次 Connect 调用一次 dial，
+// Disconnect 会关闭传输层，因此 dial 每次都要返回新的传输层
+func NewTransportScanner(usb DeviceInfo, dial func() (Transport, error), opts DeviceOptions) *CommonScanner {
+	profile, _ := LookupProfile(usb)
+	opts.Timing = opts.Timing.withDefaults()
 	return &CommonScanner{
-		usb:  usb,
-		opts: opts,
+		usb:     usb,
+		opts:    opts,
+		profile: profile,
+		dial:    dial,
 	}
 }
 
-func (scanner *CommonScanner) Connect() error {
-	scanner.state = open(scanner.usb.ParseVendorID(), scanner.usb.ParseProductID(), scanner.opts)
-	if scanner.state.device == nil {
-		return fmt.Errorf("打开设备失败！")
+func (scanner *CommonScanner) Connect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	scanner.progress = Progress{}
+	scanner.report(ctx, StageConnecting)
+	transport, err := scanner.dial()
+	if err != nil {
+		scanner.reportError(ctx, err)
+		return err
 	}
+	if scanner.opts.RecordDir != "" {
+		f, err := createRecording(scanner.opts.RecordDir, scanner.usb)
+		if err != nil {
+			transport.Close()
+			return fmt.Errorf("create recording: %w", err)
+		}
+		slog.Info("recording usb session", "file", f.Name())
+		transport = NewRecordingTransport(transport, f)
+	}
+	scanner.transport = transport
 
 	return nil
 }
 
-func (scanner *CommonScanner) Scan(out io.Writer, opts ScanOptions) error {
-	if err := scanner.control(1); err != nil {
+// Capabilities 查询设备能力，结果会被缓存直到断开连接
+func (scanner *CommonScanner) Capabilities(ctx context.Context) (*Capabilities, error) {
+	if scanner.caps != nil {
+		return scanner.caps, nil
+	}
+	if err := scanner.query(ctx); err != nil {
+		return nil, err
+	}
+	return scanner.caps, nil
+}
+
+func (scanner *CommonScanner) query(ctx context.Context) error {
+	if err := scanner.control(ctx, 1); err != nil {
 		return fmt.Errorf("1st pre-init control transfer: %w", err)
 	}
-	if _, err := scanner.queryCapabilities(); err != nil {
+	caps, err := scanner.queryCapabilities(ctx)
+	if err != nil {
 		return fmt.Errorf("query capabilities: %w", err)
 	}
-	if err := scanner.control(2); err != nil {
+	scanner.profile.applyCapabilities(caps)
+	scanner.caps = caps
+	if err := scanner.control(ctx, 2); err != nil {
 		return fmt.Errorf("1st post-query control transfer: %w", err)
 	}
-	if err := scanner.control(1); err != nil {
+	return nil
+}
+
+// Scan 扫描一页写入 out，自动进纸器扫完第一张后停止，剩余的纸张留在进纸器中，批量扫描请使用 ScanPages
+func (scanner *CommonScanner) Scan(ctx context.Context, out io.Writer, opts ScanOptions) error {
+	return scanner.scan(ctx, opts, func(index int) io.Writer {
+		if index == 0 {
+			return out
+		}
+		return nil
+	})
+}
+
+// ScanPages 扫描自动进纸器中的所有纸张，每张纸返回一页，平板只返回一页
+func (scanner *CommonScanner) ScanPages(ctx context.Context, opts ScanOptions) ([]Page, error) {
+	var buffers []*bytes.Buffer
+	err := scanner.scan(ctx, opts, func(index int) io.Writer {
+		buf := &bytes.Buffer{}
+		buffers = append(buffers, buf)
+		return buf
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pages := make([]Page, 0, len(buffers))
+	for _, buf := range buffers {
+		// 任务结束标记之前的空页
+		if buf.Len() == 0 {
+			continue
+		}
+		pages = append(pages, Page{
+			Index:  len(pages),
+			Format: opts.OutputFormat(),
+			Data:   buf.Bytes(),
+		})
+	}
+	return pages, nil
+}
+
+// scan 执行一次扫描任务，每开始一页调用一次 page 获取该页的输出，
+// 返回 nil 时不再需要更多的页，正面为 nil 时让设备停止扫描，背面为 nil 时丢弃
+func (scanner *CommonScanner) scan(ctx context.Context, opts ScanOptions, page func(index int) io.Writer) (err error) {
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("invalid scan options: %w", err)
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, scanner.opts.Timing.ScanTimeout)
+	defer cancel()
+	scanner.progress = Progress{}
+	defer func() {
+		if err != nil {
+			scanner.reportError(parent, err)
+		} else {
+			scanner.report(parent, StageDone)
+		}
+	}()
+
+	if err := scanner.query(ctx); err != nil {
+		return err
+	}
+	// 任务被取消或超时时通知设备停止扫描
+	defer func() {
+		if err != nil && parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("scan did not finish within %s: %w", scanner.opts.Timing.ScanTimeout, ErrTimeout)
+		}
+		// 取消的原因，例如 DeviceWatcher 发现设备被拔出
+		if cause := context.Cause(parent); err != nil && cause != nil && !errors.Is(err, cause) {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+		if (ctx.Err() != nil || errors.Is(err, ErrTimeout)) && !errors.Is(err, ErrDeviceGone) {
+			if err := scanner.abort(); err != nil {
+				slog.Warn("abort scan", "error", err)
+			}
+		}
+	}()
+	if !scanner.caps.SupportsMode(opts.Mode) {
+		return fmt.Errorf("scan mode %s is not supported by this device", opts.Mode)
+	}
+	if !scanner.caps.SupportsSource(opts.source()) {
+		return fmt.Errorf("scan source %s is not available on this device", opts.source())
+	}
+	if !scanner.caps.SupportsResolution(opts.DPI) {
+		return fmt.Errorf("resolution %d dpi is not supported by this device", opts.DPI)
+	}
+	if err := scanner.control(ctx, 1); err != nil {
 		return fmt.Errorf("2nd post-query control transfer: %w", err)
 	}
 
-	neg, err := scanner.negotiateScannerSettings(opts)
+	scanner.report(ctx, StageNegotiating)
+	neg, err := scanner.negotiateScannerSettings(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("negotiate scanner settings: %w", err)
 	}
 
-	if err := scanner.postNegotiate(); err != nil {
+	if err := scanner.postNegotiate(ctx, opts.source()); err != nil {
 		return fmt.Errorf("post negotiate: %w", err)
 	}
 
+	compression := opts.compression()
+	duplex := opts.source() == ScanSourceADFDuplex
 	top := mmToPixels(opts.Top, neg.verticalDPI)
 	left := mmToPixels(opts.Left, neg.horizontalDPI)
 
-	if err := scanner.startScan(scanRequest{
+	request := scanRequest{
 		horizontalDPI: neg.horizontalDPI,
 		verticalDPI:   neg.verticalDPI,
 		mode:          opts.Mode,
-		compression:   CompressionJPEG,
-		brightness:    50,
-		contrast:      50,
+		compression:   compression,
+		brightness:    uint16(50 + opts.Brightness),
+		contrast:      uint16(50 + opts.Contrast),
 		top:           top,
 		left:          left,
 		width:         min(mmToPixels(opts.Width, neg.horizontalDPI), mmToPixels(float64(neg.scanWidth), neg.horizontalDPI)),
 		height:        min(mmToPixels(opts.Height, neg.verticalDPI), mmToPixels(float64(neg.scanHeight), neg.verticalDPI)),
-	}); err != nil {
+		duplex:        duplex,
+	}
+	if err := scanner.startScan(ctx, request); err != nil {
 		return fmt.Errorf("start scan: %w", err)
 	}
+	estimate := newPageEstimate(request, neg, opts.Mode.PixelFormat())
+
+	pagesPerSheet := 1
+	if duplex {
+		pagesPerSheet = 2
+	}
+
+	// 数据块可能跨越多次 USB 读取，所以所有页共用同一个缓冲
+	in := bufio.NewReaderSize(usbReader{ctx, scanner}, 4096*4)
+	for sheet := 0; ; sheet++ {
+		index := sheet * pagesPerSheet
+		out := page(index)
+		if out == nil {
+			// ESC R 让设备停止进纸，abort 之后不需要再发送 control(2)
+			if err := scanner.abort(); err != nil {
+				return fmt.Errorf("stop after page %d: %w", index, err)
+			}
+			return nil
+		}
+		scanner.estimate = estimate
+		scanner.progress.Page = index
+		scanner.progress.Percent = 0
+		scanner.report(ctx, StageScanning)
+
+		// JPEG 数据直接输出，RLENGTH 需要读完整页后解码
+		data := out
+		var raw bytes.Buffer
+		if compression == CompressionRLENGTH {
+			data = &raw
+		}
+
+		// 双面扫描时背面单独缓存，读完后加上旋转 180 度的方向标记
+		var back bytes.Buffer
+		var backData io.Writer
+		if duplex {
+			backData = &back
+		}
+
+		marker, err := scanner.readScanData(in, data, backData)
+		if err != nil {
+			return fmt.Errorf("read scan data of page %d: %w", index+1, err)
+		}
+
+		hasBack := back.Len() > 0
+		if hasBack {
+			rotated, err := orientJPEG(back.Bytes(), exifRotate180)
+			if err != nil {
+				return fmt.Errorf("back side of page %d: %w", index+1, err)
+			}
+			if backOut := page(index + 1); backOut != nil {
+				if _, err := backOut.Write(rotated); err != nil {
+					return fmt.Errorf("write back side of page %d: %w", index+1, err)
+				}
+			}
+		}
+
+		if compression == CompressionRLENGTH && raw.Len() > 0 {
+			img, err := DecodeRLENGTH(&raw, opts.Mode.PixelFormat())
+			if err != nil {
+				return fmt.Errorf("decode page %d: %w", index+1, err)
+			}
+			if err := EncodeImage(out, img, opts.OutputFormat()); err != nil {
+				return fmt.Errorf("encode page %d as %s: %w", index+1, opts.OutputFormat(), err)
+			}
+		}
+
+		if marker == endOfPage {
+			scanner.progress.Pages = index + 1
+			if hasBack {
+				scanner.progress.Pages++
+			}
+			scanner.progress.Percent = 100
+			scanner.report(ctx, StagePageComplete)
+		}
 
-	if err := scanner.readScanData(out); err != nil {
-		return fmt.Errorf("read scan data: %w", err)
+		// 平板只有一页，自动进纸器在最后一页后发送任务结束标记
+		if marker == endOfJob || opts.source() == ScanSourceFlatbed {
+			break
+		}
 	}
 
-	if err := scanner.control(2); err != nil {
+	if err := scanner.control(ctx, 2); err != nil {
 		return fmt.Errorf("post-scan control: %w", err)
 	}
 	return nil
 }
 
 func (scanner *CommonScanner) Disconnect() error {
-	return scanner.state.Close()
+	scanner.caps = nil
+	if scanner.transport == nil {
+		return nil
+	}
+	err := scanner.transport.Close()
+	scanner.transport = nil
+	return err
 }
 
 // We only see 0x0c0 control transfers, they always have value 0x0002 and index 0, the data is always 5 bytes long.
-func (scanner *CommonScanner) control(request uint8) error {
+func (scanner *CommonScanner) control(ctx context.Context, request uint8) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	data := make([]byte, 5)
-	_, err := scanner.state.device.Control(0xc0, request, 0x0002, 0, data)
+	err := scanner.retry(ctx, func() error {
+		_, err := scanner.transport.Control(ctx, 0xc0, request, 0x0002, 0, data)
+		return err
+	})
 	if err != nil {
+		traceError(ctx, fmt.Sprintf("control(%d)", request), err)
 		return fmt.Errorf("control transfer: %w", err)
 	}
+	traceResponse(ctx, fmt.Sprintf("control(%d)", request), data)
 	return nil
 }
 
@@ -119,18 +388,22 @@ Response:
 0040   c1 00 1c 09 ff 3f 00 00 00 00 00 00 00 01 04 01   .....?..........
 0050   01 01 01 01 00 00 00 00 00 00 00 00 00 01         ..............
 */
-func (scanner *CommonScanner) queryCapabilities() ([]byte, error) {
+func (scanner *CommonScanner) queryCapabilities(ctx context.Context) (*Capabilities, error) {
 	cmd := []byte{0x1b, 0x51, 0x0a, 0x80} // 0x51 = 'Q'
-	if _, err := scanner.state.out.Write(cmd); err != nil {
+	if err := scanner.send(ctx, cmd); err != nil {
 		return nil, fmt.Errorf("sending request: %w", err)
 	}
-	// NOTE: this is probably returning a list of capabilities the scanner supports
-	//       it needs to be understood further
-	if resp, err := scanner.waitForResponse(281); err != nil {
+	rawData, err := scanner.waitForResponse(ctx, 281)
+	if err != nil {
 		return nil, err
-	} else {
-		return resp, nil
 	}
+
+	caps := &Capabilities{}
+	if err := caps.parse(rawData); err != nil {
+		return nil, fmt.Errorf("parse response: %w", err)
+	}
+
+	return caps, nil
 }
 
 /*
@@ -142,11 +415,11 @@ Response:
 0040   00 1d 00 33 30 30 2c 33 30 30 2c 32 2c 32 30 39   ...300,300,2,209
 0050   2c 32 34 38 30 2c 32 39 31 2c 33 34 33 37 2c 00   ,2480,291,3437,.
 */
-func (scanner *CommonScanner) negotiateScannerSettings(opts ScanOptions) (*negotiateResponse, error) {
-	if _, err := scanner.state.out.Write(negotiateRequest(opts.DPI, opts.Mode)); err != nil {
+func (scanner *CommonScanner) negotiateScannerSettings(ctx context.Context, opts ScanOptions) (*negotiateResponse, error) {
+	if err := scanner.send(ctx, negotiateRequest(opts.DPI, opts.Mode)); err != nil {
 		return nil, fmt.Errorf("sending command: %w", err)
 	}
-	rawData, err := scanner.waitForResponse(281)
+	rawData, err := scanner.waitForResponse(ctx, 281)
 	if err != nil {
 		return nil, err
 	}
@@ -165,52 +438,181 @@ Request:
 
 Response:
 0040   d0                                                .
+
+FB selects the flatbed and DUP the duplex ADF. When the ADF is selected
+without any paper loaded the device answers c2 (ErrNoPaper) instead.
 */
-func (scanner *CommonScanner) postNegotiate() error {
-	cmd := []byte{0x1b, 0x44, 0x0a, 0x41, 0x44, 0x46, 0x0a, 0x80}
-	if _, err := scanner.state.out.Write(cmd); err != nil {
+func (scanner *CommonScanner) postNegotiate(ctx context.Context, source ScanSource) error {
+	if err := scanner.send(ctx, selectSourceRequest(source)); err != nil {
 		return fmt.Errorf("send command: %w", err)
 	}
 
-	_, err := scanner.waitForResponse(64)
-	if err != nil {
-		return err
+	if _, err := scanner.waitForResponse(ctx, 64); err != nil {
+		return fmt.Errorf("select %s: %w", source, err)
 	}
 	return nil
 }
 
 /*
-Response for JPEG compression:
+Response:
+
+The scan data is a sequence of blocks, see frameHeader. JPEG blocks carry a
+part of the JPEG file, RLENGTH blocks carry one scan line each and are
+passed on with their header for DecodeRLENGTH.
+
+In duplex mode the JPEG blocks of both sides of a sheet are interleaved,
+odd page numbers are the front and even page numbers the back side. The
+back side is written to back, the front side to out.
+
+Each page ends with a single 0x80 byte. When the ADF runs out of paper the
+device sends a single 0x81 byte instead, which ends the whole job.
 
 This is a preamble that sometimes starts a frame, it probably contains the length of the image data in the current "batch", maybe page?
 0000   00 60 e4 e8 46 9f ff ...
 
-I'm currently ignoring that and just writing the whole file to output.
+Its length is not known, so it is skipped up to the next JPEG block header,
+see skipPreamble.
 */
-func (scanner *CommonScanner) readScanData(out io.Writer) error {
-	buf := make([]byte, 4096*4)
+func (scanner *CommonScanner) readScanData(data *bufio.Reader, out, back io.Writer) (byte, error) {
+	sheet := -1
 	for {
-		n, err := scanner.state.in.Read(buf)
+		next, err := data.Peek(1)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		if n == 0 {
+		if next[0] == endOfPage || next[0] == endOfJob {
+			data.Discard(1)
+			return next[0], nil
+		}
+		if isStatus(next[0]) {
+			return 0, readStatus(data)
+		}
+		if next[0] == framePreamble {
+			if err := skipPreamble(data); err != nil {
+				return 0, fmt.Errorf("malformed frame: %w", err)
+			}
 			continue
 		}
-		if n == 1 && buf[0] == 0x80 {
-			break
+
+		size := frameHeaderSize(next[0], scanner.profile.jpegHeaderSize())
+		if size == 0 {
+			return 0, fmt.Errorf("malformed frame: unknown block type 0x%02x", next[0])
+		}
+		raw, err := data.Peek(size)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
 		}
-		startOffset := 0
-		// Sometimes we get some headers
-		// NOTE: understand what they mean, we're currently skipping them, but it will probably break
-		if len(buf) > 12 && buf[0] == 0x64 && buf[1] == 0x07 && buf[2] == 0x00 {
-			startOffset = 12
+		if err != nil {
+			return 0, fmt.Errorf("read frame header: %w", err)
+		}
+		header := frameHeader{}
+		if err := header.parse(raw, scanner.profile.jpegHeaderSize()); err != nil {
+			return 0, fmt.Errorf("malformed frame: %w", err)
 		}
-		if _, err := out.Write(buf[startOffset:n]); err != nil {
-			return fmt.Errorf("send to writer: %w", err)
+
+		n := int64(header.length)
+		dst := out
+		if header.blockType == frameJPEG {
+			current := int(header.page)
+			if back != nil {
+				current = (current + 1) / 2
+				if header.page%2 == 0 {
+					dst = back
+				}
+			}
+			if sheet == -1 {
+				sheet = current
+			}
+			if current != sheet {
+				return 0, fmt.Errorf("malformed frame: block of page %d inside page %d", header.page, sheet)
+			}
+			data.Discard(size)
+		} else {
+			// 行数据的块头由 DecodeRLENGTH 解析，因此和数据一起输出
+			n += int64(size)
+		}
+
+		if _, err := io.CopyN(dst, data, n); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, fmt.Errorf("read %d bytes of block 0x%02x: %w", header.length, header.blockType, err)
+		}
+		if header.blockType != frameJPEG {
+			scanner.estimate.line()
+		}
+	}
+}
+
+// skipPreamble 跳过数据块之前的前导字节，直到下一个 JPEG 块头
+func skipPreamble(data *bufio.Reader) error {
+	raw, err := data.Peek(maxPreambleSize)
+	if i := bytes.Index(raw, jpegBlockPrefix); i > 0 {
+		data.Discard(i)
+		return nil
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("read preamble: %w", err)
+	}
+	return fmt.Errorf("no block after preamble % x", raw[:min(len(raw), 8)])
+}
+
+// readStatus 读取扫描过程中设备发送的状态响应
+func readStatus(data *bufio.Reader) error {
+	size := 1
+	if next, _ := data.Peek(1); next[0] == statusPrefix {
+		size = 3
+	}
+	resp, err := data.Peek(size)
+	if err != nil {
+		return fmt.Errorf("read status: %w", err)
+	}
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	return fmt.Errorf("malformed frame: unexpected status % x", resp)
+}
+
+// usbReader 跳过设备返回的空数据包，超过 IdleTimeout 没有收到数据时返回 ErrTimeout
+type usbReader struct {
+	ctx     context.Context
+	scanner *CommonScanner
+}
+
+func (r usbReader) Read(p []byte) (int, error) {
+	timing := r.scanner.opts.Timing
+	ctx, cancel := context.WithTimeout(r.ctx, timing.IdleTimeout)
+	defer cancel()
+
+	for {
+		var n int
+		err := r.scanner.retry(ctx, func() (err error) {
+			n, err = r.scanner.transport.Read(ctx, p)
+			return err
+		})
+		if err != nil {
+			return n, deadlineError(r.ctx, ctx, err, fmt.Sprintf("no scan data for %s", timing.IdleTimeout))
+		}
+		if n > 0 {
+			traceResponse(r.ctx, "scan data", p[:n])
+			r.scanner.progress.Received += int64(n)
+			r.scanner.estimate.receive(n)
+			// 每次读取只有几 KB，只在百分比变化时报告
+			if percent := r.scanner.estimate.percent(); percent != r.scanner.progress.Percent {
+				r.scanner.progress.Percent = percent
+				r.scanner.report(r.ctx, StageScanning)
+			}
+			return n, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, deadlineError(r.ctx, ctx, ctx.Err(), fmt.Sprintf("no scan data for %s", timing.IdleTimeout))
+		case <-time.After(timing.PollInterval):
 		}
 	}
-	return nil
 }
 
 /*
@@ -226,35 +628,113 @@ Response:
 scan data
 
 or
-0040   1b 52                                             .R
+0040   1b 52 c3                                          .R.
 
-in case of error?
+in case of error, see checkStatus.
 */
-func (scanner *CommonScanner) startScan(request scanRequest) error {
-	if _, err := scanner.state.out.Write(request.Bytes()); err != nil {
+func (scanner *CommonScanner) startScan(ctx context.Context, request scanRequest) error {
+	if err := scanner.send(ctx, request.Bytes()); err != nil {
 		return fmt.Errorf("send command: %w", err)
 	}
 	return nil
 }
 
-func (scanner *CommonScanner) waitForResponse(len int) ([]byte, error) {
+/*
+Request:
+0040   1b 52 0a 80                                       .R..
+
+Cancels the running scan, a sheet that is being fed through the ADF is
+ejected. The request context is already done at this point, so it gets
+its own deadline.
+*/
+func (scanner *CommonScanner) abort() error {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	cmd := []byte{0x1b, 0x52, 0x0a, 0x80} // 0x52 = 'R'
+	if err := scanner.send(ctx, cmd); err != nil {
+		return fmt.Errorf("send command: %w", err)
+	}
+	return scanner.control(ctx, 2)
+}
+
+func (scanner *CommonScanner) waitForResponse(ctx context.Context, len int) ([]byte, error) {
+	timing := scanner.opts.Timing
+	cmdCtx, cancel := context.WithTimeout(ctx, timing.CommandTimeout)
+	defer cancel()
+
 	buf := make([]byte, len)
-	for i := 0; ; i++ {
-		if i > ResponseTimeoutIt {
-			return nil, fmt.Errorf("timeout waiting for response")
-		}
-		packetLen, err := scanner.state.in.Read(buf)
+	for {
+		var packetLen int
+		err := scanner.retry(cmdCtx, func() (err error) {
+			packetLen, err = scanner.transport.Read(cmdCtx, buf)
+			return err
+		})
 		if err != nil {
-			return nil, fmt.Errorf("read response: %w", err)
+			return nil, fmt.Errorf("read response: %w", deadlineError(ctx, cmdCtx, err, "waiting for response"))
 		}
 		if packetLen == 0 {
-			time.Sleep(WaitBetweenRequests)
+			select {
+			case <-cmdCtx.Done():
+				return nil, deadlineError(ctx, cmdCtx, cmdCtx.Err(), "waiting for response")
+			case <-time.After(timing.PollInterval):
+			}
 			continue
 		}
+		traceResponse(ctx, "response", buf[:packetLen])
+		if err := checkStatus(buf[:packetLen]); err != nil {
+			return nil, err
+		}
 		return buf[:packetLen], nil
 	}
 }
 
+// send 在 CommandTimeout 内发送一条命令
+func (scanner *CommonScanner) send(ctx context.Context, cmd []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, scanner.opts.Timing.CommandTimeout)
+	defer cancel()
+
+	traceCommand(ctx, cmd)
+	return scanner.retry(ctx, func() error {
+		_, err := scanner.transport.Write(ctx, cmd)
+		return err
+	})
+}
+
+// retry 遇到暂时性USB错误时按退避策略重试，端点的 halt 已由 DeviceState 在返回 stall 前清除
+func (scanner *CommonScanner) retry(ctx context.Context, op func() error) error {
+	timing := scanner.opts.Timing
+	backoff := timing.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt > timing.Retries || !isTransient(err) {
+			return err
+		}
+		slog.Warn("transient usb error, retrying", "error", err, "attempt", attempt)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isTransient 端点 stall 等错误通常重试即可恢复
+func isTransient(err error) bool {
+	return errors.Is(err, gousb.TransferStall) ||
+		errors.Is(err, gousb.ErrorPipe) ||
+		errors.Is(err, gousb.ErrorInterrupted)
+}
+
+// deadlineError 子上下文超时而父上下文仍有效时，说明是本次操作超时
+func deadlineError(parent, ctx context.Context, err error, what string) error {
+	if parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s: %w", what, ErrTimeout)
+	}
+	return err
+}
+
 func mmToPixels(mm float64, dpi uint16) uint16 {
 	return uint16(mm * float64(dpi) / 25.4)
 }
@@ -0,0 +1,413 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/google/gousb"
+)
+
+// jpegBlock JPEG 数据块，块头格式见 frameHeader
+func jpegBlock(page uint16, payload ...byte) []byte {
+	block := []byte{frameJPEG, 0x07, 0x00, byte(page), byte(page >> 8), 0, 0, 0, 0, 0, byte(len(payload)), byte(len(payload) >> 8)}
+	return append(block, payload...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadScanData(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		// oneByte 每次读取只返回一个字节，块头被拆分到多次读取中
+		oneByte bool
+		duplex  bool
+		marker  byte
+		out     []byte
+		back    []byte
+		target  error
+	}{
+		{
+			name:   "single block",
+			data:   join(jpegBlock(1, 0xff, 0xd8), []byte{endOfPage}),
+			marker: endOfPage,
+			out:    []byte{0xff, 0xd8},
+		},
+		{
+			name:   "end of job",
+			data:   join(jpegBlock(1, 0x01), jpegBlock(1, 0x02), []byte{endOfJob}),
+			marker: endOfJob,
+			out:    []byte{0x01, 0x02},
+		},
+		{
+			name:   "preamble",
+			data:   join([]byte{0x00, 0x60, 0xe4, 0xe8, 0x46, 0x9f}, jpegBlock(1, 0xff, 0xd8), []byte{endOfPage}),
+			marker: endOfPage,
+			out:    []byte{0xff, 0xd8},
+		},
+		{
+			name:   "preamble between blocks",
+			data:   join(jpegBlock(1, 0x01), []byte{0x00, 0x60, 0xe4}, jpegBlock(1, 0x02), []byte{endOfPage}),
+			marker: endOfPage,
+			out:    []byte{0x01, 0x02},
+		},
+		{
+			name:    "split header",
+			data:    join(jpegBlock(1, 0x01, 0x02, 0x03), jpegBlock(1, 0x04), []byte{endOfPage}),
+			oneByte: true,
+			marker:  endOfPage,
+			out:     []byte{0x01, 0x02, 0x03, 0x04},
+		},
+		{
+			name:   "duplex",
+			data:   join(jpegBlock(1, 0x01), jpegBlock(2, 0x02), jpegBlock(1, 0x03), []byte{endOfPage}),
+			duplex: true,
+			marker: endOfPage,
+			out:    []byte{0x01, 0x03},
+			back:   []byte{0x02},
+		},
+		{
+			name:   "raster lines",
+			data:   join(rasterLine(rasterLineGray, 0x01, 0x02), []byte{endOfPage}),
+			marker: endOfPage,
+			out:    rasterLine(rasterLineGray, 0x01, 0x02),
+		},
+		{
+			name:   "truncated block",
+			data:   jpegBlock(1, 0x01, 0x02, 0x03)[:13],
+			target: io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "truncated header",
+			data:   jpegBlock(1, 0x01)[:8],
+			target: io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "preamble without block",
+			data:   []byte{0x00, 0x60, 0xe4, 0xe8},
+			target: io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "status",
+			data:   join(jpegBlock(1, 0x01), []byte{0xc3}),
+			target: ErrPaperJam,
+		},
+		{
+			name:   "esc r status",
+			data:   join(jpegBlock(1, 0x01), []byte{0x1b, 'R', 0xc4}),
+			target: ErrCoverOpen,
+		},
+		{
+			// 只有块边界上的字节才可能是状态
+			name:   "status bytes in data",
+			data:   join(jpegBlock(1, 0xc2, 0x1b, 'R', 0xc3), []byte{endOfPage}),
+			marker: endOfPage,
+			out:    []byte{0xc2, 0x1b, 'R', 0xc3},
+		},
+		{
+			name: "unknown block",
+			data: []byte{0x30, 0x01, 0x02},
+		},
+		{
+			name: "page changes",
+			data: join(jpegBlock(1, 0x01), jpegBlock(2, 0x02)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(tt.data)
+			if tt.oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			var out, back bytes.Buffer
+			var backOut io.Writer
+			if tt.duplex {
+				backOut = &back
+			}
+
+			scanner := &CommonScanner{}
+			marker, err := scanner.readScanData(bufio.NewReader(r), &out, backOut)
+			if tt.out == nil {
+				if err == nil {
+					t.Fatalf("readScanData succeeded with marker 0x%02x, want an error", marker)
+				}
+				if tt.target != nil && !errors.Is(err, tt.target) {
+					t.Errorf("error %v, want %v", err, tt.target)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readScanData: %v", err)
+			}
+			if marker != tt.marker {
+				t.Errorf("marker 0x%02x, want 0x%02x", marker, tt.marker)
+			}
+			if !bytes.Equal(out.Bytes(), tt.out) {
+				t.Errorf("out % x, want % x", out.Bytes(), tt.out)
+			}
+			if !bytes.Equal(back.Bytes(), tt.back) {
+				t.Errorf("back % x, want % x", back.Bytes(), tt.back)
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport *fakeTransport
+		requests  []uint8
+		target    error
+		wantErr   bool
+	}{
+		{
+			name:      "m7206",
+			transport: newFakeTransport(m7206Capabilities),
+			requests:  []uint8{1, 2},
+		},
+		{
+			name:      "empty packets",
+			transport: newFakeTransport(nil, nil, m7206Capabilities),
+			requests:  []uint8{1, 2},
+		},
+		{
+			name:      "stall",
+			transport: newFakeTransport(m7206Capabilities).failRead(0, gousb.TransferStall),
+			requests:  []uint8{1, 2},
+		},
+		{
+			name:      "busy",
+			transport: newFakeTransport([]byte{0xc5}),
+			requests:  []uint8{1},
+			target:    ErrDeviceBusy,
+		},
+		{
+			name:      "malformed",
+			transport: newFakeTransport([]byte{0xc1, 0x00, 0x1c}),
+			requests:  []uint8{1},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner := newFakeScanner(tt.transport)
+			err := scanner.query(context.Background())
+			switch {
+			case tt.target != nil && !errors.Is(err, tt.target):
+				t.Fatalf("error %v, want %v", err, tt.target)
+			case tt.target == nil && tt.wantErr != (err != nil):
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+
+			if got := tt.transport.requests(); !slices.Equal(got, tt.requests) {
+				t.Errorf("control requests %v, want %v", got, tt.requests)
+			}
+			if len(tt.transport.writes) != 1 || !bytes.Equal(tt.transport.writes[0], []byte("\x1bQ\x0a\x80")) {
+				t.Errorf("commands %q, want one ESC Q", tt.transport.writes)
+			}
+			if err == nil && (scanner.caps == nil || !scanner.caps.ADF) {
+				t.Errorf("capabilities %+v, want the M7206 capabilities", scanner.caps)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name    string
+		dpi     uint16
+		mode    ScanMode
+		reply   []byte
+		command string
+		want    negotiateResponse
+		wantErr bool
+	}{
+		{
+			name:    "color",
+			dpi:     300,
+			mode:    ScanModeCGRAY,
+			reply:   append([]byte("\x00\x1d\x00300,300,2,209,2480,291,3437,"), 0x00),
+			command: "\x1bI\nR=300,300\nM=CGRAY\n\x80",
+			want: negotiateResponse{
+				unknown:       [3]byte{0x00, 0x1d, 0x00},
+				horizontalDPI: 300, verticalDPI: 300, unknown2: 2,
+				scanWidth: 209, outWidth: 2480, scanHeight: 291, outHeight: 3437,
+			},
+		},
+		{
+			name:    "gray",
+			dpi:     100,
+			mode:    ScanModeTrueGray,
+			reply:   append([]byte("\x00\x1a\x00100,100,2,209,826,291,1145,"), 0x00),
+			command: "\x1bI\nR=100,100\nM=GRAY64\n\x80",
+			want: negotiateResponse{
+				unknown:       [3]byte{0x00, 0x1a, 0x00},
+				horizontalDPI: 100, verticalDPI: 100, unknown2: 2,
+				scanWidth: 209, outWidth: 826, scanHeight: 291, outHeight: 1145,
+			},
+		},
+		{
+			name:    "malformed",
+			dpi:     300,
+			mode:    ScanModeCGRAY,
+			reply:   []byte("\x00\x1d\x00300,x,2,209\x00"),
+			command: "\x1bI\nR=300,300\nM=CGRAY\n\x80",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newFakeTransport(tt.reply)
+			scanner := newFakeScanner(transport)
+			opts := DefaultScanOptions
+			opts.DPI, opts.Mode = tt.dpi, tt.mode
+
+			neg, err := scanner.negotiateScannerSettings(context.Background(), opts)
+			if len(transport.writes) != 1 || string(transport.writes[0]) != tt.command {
+				t.Errorf("commands %q, want %q", transport.writes, tt.command)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("negotiate succeeded with %+v, want an error", neg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("negotiate: %v", err)
+			}
+			if *neg != tt.want {
+				t.Errorf("response %+v, want %+v", *neg, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		request scanRequest
+		command string
+	}{
+		{
+			name: "rlength",
+			request: scanRequest{
+				horizontalDPI: 100, verticalDPI: 100, mode: ScanModeTrueGray, compression: CompressionRLENGTH,
+				brightness: 50, contrast: 50, left: 32, top: 42, width: 816, height: 1145,
+			},
+			command: "\x1bX\nR=100,100\nM=GRAY64\nC=RLENGTH\nJ=MID\nB=50\nN=50\nA=32,42,816,1145\nS=NORMAL_SCAN\nP=0\nG=0\nL=0\n\x80",
+		},
+		{
+			name: "duplex",
+			request: scanRequest{
+				horizontalDPI: 300, verticalDPI: 300, mode: ScanModeCGRAY, compression: CompressionJPEG,
+				brightness: 60, contrast: 40, width: 2480, height: 3437, duplex: true,
+			},
+			command: "\x1bX\nR=300,300\nM=CGRAY\nC=JPEG\nJ=MID\nB=60\nN=40\nA=0,0,2480,3437\nS=DUPLEX_SCAN\nP=0\nG=0\nL=0\n\x80",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newFakeTransport()
+			scanner := newFakeScanner(transport)
+			if err := scanner.startScan(context.Background(), tt.request); err != nil {
+				t.Fatalf("startScan: %v", err)
+			}
+			if len(transport.writes) != 1 || string(transport.writes[0]) != tt.command {
+				t.Errorf("commands %q, want %q", transport.writes, tt.command)
+			}
+		})
+	}
+}
+
+func TestScanUnsupportedOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ScanOptions
+		want string
+	}{
+		{"source", smallScan(ScanSourceADFDuplex, ScanModeCGRAY), "scan source"},
+		// M7206 上报了 2400 dpi，超过 MaxResolution 的分辨率被去掉
+		{"resolution", smallScan(ScanSourceFlatbed, ScanModeCGRAY), "resolution 2400 dpi"},
+	}
+	tests[1].opts.DPI = 2400
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newFakeTransport(m7206Capabilities)
+			scanner := newFakeScanner(transport)
+			if err := scanner.Scan(context.Background(), io.Discard, tt.opts); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want %s is not supported", err, tt.want)
+			}
+			if len(transport.writes) != 1 {
+				t.Errorf("commands %q, want only ESC Q before rejecting the options", transport.writes)
+			}
+		})
+	}
+}
+
+func TestConnectRedials(t *testing.T) {
+	var dialed []*fakeTransport
+	scanner := NewTransportScanner(DeviceInfo{}, func() (Transport, error) {
+		transport := newFakeTransport()
+		dialed = append(dialed, transport)
+		return transport, nil
+	}, DefaultDeviceOptions)
+
+	ctx := context.Background()
+	for range 2 {
+		if err := scanner.Connect(ctx); err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		if err := scanner.Disconnect(); err != nil {
+			t.Fatalf("disconnect: %v", err)
+		}
+	}
+	if len(dialed) != 2 {
+		t.Fatalf("dialed %d times, want 2", len(dialed))
+	}
+	if !dialed[0].closed || !dialed[1].closed || dialed[0] == dialed[1] {
+		t.Error("each connection should use and close its own transport")
+	}
+}
+
+func TestReadScanDataFromTransport(t *testing.T) {
+	block := jpegBlock(1, 0xff, 0xd8, 0xff, 0xd9)
+	tests := []struct {
+		name      string
+		transport *fakeTransport
+	}{
+		{"one packet", newFakeTransport(join(block, []byte{endOfPage}))},
+		{"split header", newFakeTransport(block[:5], block[5:], []byte{endOfPage})},
+		{"empty packets", newFakeTransport(nil, block, nil, nil, []byte{endOfPage})},
+		{"stall", newFakeTransport(block, []byte{endOfPage}).failRead(1, gousb.TransferStall)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner := newFakeScanner(tt.transport)
+			in := bufio.NewReader(usbReader{context.Background(), scanner})
+
+			var out bytes.Buffer
+			marker, err := scanner.readScanData(in, &out, nil)
+			if err != nil {
+				t.Fatalf("readScanData: %v", err)
+			}
+			if marker != endOfPage {
+				t.Errorf("marker 0x%02x, want end of page", marker)
+			}
+			if want := []byte{0xff, 0xd8, 0xff, 0xd9}; !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("out % x, want % x", out.Bytes(), want)
+			}
+			if scanner.progress.Received != int64(len(block)+1) {
+				t.Errorf("received %d bytes, want %d", scanner.progress.Received, len(block)+1)
+			}
+		})
+	}
+}
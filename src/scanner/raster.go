@@ -0,0 +1,294 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/tiff"
+)
+
+type ImageFormat string
+
+var (
+	ImageFormatJPEG ImageFormat = "JPEG"
+	ImageFormatPNG  ImageFormat = "PNG"
+	ImageFormatTIFF ImageFormat = "TIFF"
+)
+
+// Ext 文件扩展名
+func (format ImageFormat) Ext() string {
+	switch format {
+	case ImageFormatPNG:
+		return ".png"
+	case ImageFormatTIFF:
+		return ".tiff"
+	default:
+		return ".jpg"
+	}
+}
+
+/*
+Response for RLENGTH compression:
+
+Every scan line is sent as its own record, a type byte followed by the
+little endian length of the line data:
+
+0000   42 d4 00 ff 00 fe ff 02 00 ...
+
+	0x40 gray/mono line        0x42 the same, PackBits compressed
+	0x44 red plane of a line   0x46 the same, PackBits compressed
+	0x48 green plane           0x4a the same, PackBits compressed
+	0x4c blue plane            0x4e the same, PackBits compressed
+
+A color line is complete once its blue plane arrived.
+*/
+const (
+	rasterLineGray  = 0x40
+	rasterLineRed   = 0x44
+	rasterLineGreen = 0x48
+	rasterLineBlue  = 0x4c
+
+	rasterCompressed = 0x02
+)
+
+// DecodeRLENGTH 将 RLENGTH 压缩的原始扫描数据解码为图像
+func DecodeRLENGTH(r io.Reader, format PixelFormat) (image.Image, error) {
+	br := bufio.NewReader(r)
+
+	var (
+		rows  [][]byte
+		width int
+		// 彩色模式下同一行的 R、G、B 三个通道
+		planes [3][]byte
+	)
+	header := make([]byte, 3)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("read line header: %w", err)
+		}
+
+		data := make([]byte, binary.LittleEndian.Uint16(header[1:]))
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("read line %d: %w", len(rows), err)
+		}
+
+		kind := header[0] &^ rasterCompressed
+		if header[0]&rasterCompressed != 0 {
+			var err error
+			if data, err = unpackBits(data); err != nil {
+				return nil, fmt.Errorf("decompress line %d: %w", len(rows), err)
+			}
+		}
+
+		switch kind {
+		case rasterLineGray:
+			rows = append(rows, data)
+		case rasterLineRed, rasterLineGreen:
+			planes[(kind-rasterLineRed)/4] = data
+			continue
+		case rasterLineBlue:
+			planes[2] = data
+			line, err := interleave(planes)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", len(rows), err)
+			}
+			rows = append(rows, line)
+			planes = [3][]byte{}
+		default:
+			return nil, fmt.Errorf("unknown line type 0x%02x at line %d", header[0], len(rows))
+		}
+
+		if width == 0 {
+			width = len(rows[0])
+		}
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no image data")
+	}
+
+	return buildImage(rows, width, format)
+}
+
+// unpackBits 解压 PackBits 编码的一行数据
+func unpackBits(src []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(src)*2)
+	for i := 0; i < len(src); {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0:
+			if i+n+1 > len(src) {
+				return nil, fmt.Errorf("literal run overflows line")
+			}
+			dst = append(dst, src[i:i+n+1]...)
+			i += n + 1
+		case n != -128:
+			if i >= len(src) {
+				return nil, fmt.Errorf("repeat run overflows line")
+			}
+			for range 1 - n {
+				dst = append(dst, src[i])
+			}
+			i++
+		}
+	}
+	return dst, nil
+}
+
+func interleave(planes [3][]byte) ([]byte, error) {
+	if len(planes[0]) != len(planes[1]) || len(planes[1]) != len(planes[2]) {
+		return nil, fmt.Errorf("color planes differ in length: %d/%d/%d", len(planes[0]), len(planes[1]), len(planes[2]))
+	}
+	line := make([]byte, 0, len(planes[0])*3)
+	for i := range planes[0] {
+		line = append(line, planes[0][i], planes[1][i], planes[2][i])
+	}
+	return line, nil
+}
+
+func buildImage(rows [][]byte, width int, format PixelFormat) (image.Image, error) {
+	bytesPerPixel := max(format.BitsPerPixel()/8, 1)
+	pixels := width / bytesPerPixel
+	if format == PixelFormatMono {
+		pixels = width * 8
+	}
+	rect := image.Rect(0, 0, pixels, len(rows))
+
+	switch format {
+	case PixelFormatMono:
+		img := image.NewPaletted(rect, color.Palette{color.White, color.Black})
+		for y, row := range rows {
+			for x := range min(len(row)*8, pixels) {
+				img.Pix[y*img.Stride+x] = row[x/8] >> (7 - x%8) & 1
+			}
+		}
+		return img, nil
+	case PixelFormatGray:
+		img := image.NewGray(rect)
+		for y, row := range rows {
+			copy(img.Pix[y*img.Stride:(y+1)*img.Stride], row)
+		}
+		return img, nil
+	case PixelFormatIndexed:
+		img := image.NewPaletted(rect, rgb332Palette())
+		for y, row := range rows {
+			copy(img.Pix[y*img.Stride:(y+1)*img.Stride], row)
+		}
+		return img, nil
+	case PixelFormatRGB:
+		img := image.NewRGBA(rect)
+		for y, row := range rows {
+			for x := range min(len(row)/3, pixels) {
+				copy(img.Pix[y*img.Stride+x*4:], row[x*3:x*3+3])
+				img.Pix[y*img.Stride+x*4+3] = 0xff
+			}
+		}
+		return img, nil
+	default:
+		return nil, fmt.Errorf("unsupported pixel format %q", format)
+	}
+}
+
+/*
+orientJPEG 在 JPEG 数据中插入只含 Orientation 的 EXIF 段，图像数据不重新编码，
+查看时按方向标记旋转。EXIF 段在 SOI 和 JFIF APP0 之后：
+
+	ff e1 00 22 45 78 69 66 00 00                 APP1, "Exif\0\0"
+	4d 4d 00 2a 00 00 00 08                       TIFF header, big endian
+	00 01 01 12 00 03 00 00 00 01 00 03 00 00     1 entry: Orientation, SHORT, 1, value
+	00 00 00 00                                   no next IFD
+*/
+func orientJPEG(data []byte, orientation uint16) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, fmt.Errorf("not a JPEG image")
+	}
+	pos := 2
+	if len(data) >= pos+4 && data[pos] == 0xff && data[pos+1] == 0xe0 {
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:pos+4]))
+		if pos > len(data) {
+			return nil, fmt.Errorf("truncated JFIF segment")
+		}
+	}
+
+	exif := []byte{
+		0xff, 0xe1, 0x00, 0x22, 'E', 'x', 'i', 'f', 0x00, 0x00,
+		'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08,
+		0x00, 0x01, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, byte(orientation >> 8), byte(orientation), 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	oriented := make([]byte, 0, len(data)+len(exif))
+	oriented = append(oriented, data[:pos]...)
+	oriented = append(oriented, exif...)
+	return append(oriented, data[pos:]...), nil
+}
+
+// exifRotate180 EXIF Orientation 的值，图像需要旋转 180 度显示
+const exifRotate180 = 3
+
+// rotate180 旋转 180 度，模拟设备用它生成倒置的背面
+func rotate180(img image.Image) image.Image {
+	bounds := img.Bounds()
+	if gray, ok := img.(*image.Gray); ok {
+		rotated := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		for y := range bounds.Dy() {
+			src := gray.Pix[gray.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:bounds.Dx()]
+			dst := rotated.Pix[(bounds.Dy()-1-y)*rotated.Stride:]
+			for x, v := range src {
+				dst[bounds.Dx()-1-x] = v
+			}
+		}
+		return rotated
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	rotated := image.NewRGBA(src.Bounds())
+	for y := range bounds.Dy() {
+		row := src.Pix[y*src.Stride : y*src.Stride+bounds.Dx()*4]
+		dst := rotated.Pix[(bounds.Dy()-1-y)*rotated.Stride:]
+		for x := range bounds.Dx() {
+			copy(dst[(bounds.Dx()-1-x)*4:], row[x*4:x*4+4])
+		}
+	}
+	return rotated
+}
+
+// rgb332Palette 256 色模式下设备使用固定的 3-3-2 调色板
+func rgb332Palette() color.Palette {
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.RGBA{
+			R: uint8((i >> 5) * 255 / 7),
+			G: uint8((i >> 2 & 0x07) * 255 / 7),
+			B: uint8((i & 0x03) * 255 / 3),
+			A: 0xff,
+		}
+	}
+	return palette
+}
+
+// EncodeImage 按指定格式输出图像，PNG 和 TIFF 均为无损格式
+func EncodeImage(w io.Writer, img image.Image, format ImageFormat) error {
+	switch format {
+	case ImageFormatPNG:
+		return png.Encode(w, img)
+	case ImageFormatTIFF:
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+	case ImageFormatJPEG:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 95})
+	default:
+		return fmt.Errorf("unsupported image format %q", format)
+	}
+}
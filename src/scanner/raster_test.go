@@ -0,0 +1,154 @@
+package scanner
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"testing"
+)
+
+func TestUnpackBits(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "literal", src: []byte{0x02, 0x01, 0x02, 0x03}, want: []byte{0x01, 0x02, 0x03}},
+		{name: "repeat", src: []byte{0xfd, 0xaa}, want: []byte{0xaa, 0xaa, 0xaa, 0xaa}},
+		{name: "mixed", src: []byte{0x00, 0x10, 0xff, 0x20, 0x01, 0x30, 0x31}, want: []byte{0x10, 0x20, 0x20, 0x30, 0x31}},
+		{name: "no-op", src: []byte{0x80, 0x00, 0x42}, want: []byte{0x42}},
+		{name: "empty", src: nil, want: []byte{}},
+		{name: "truncated literal", src: []byte{0x03, 0x01, 0x02}, wantErr: true},
+		{name: "truncated repeat", src: []byte{0x00, 0x10, 0xfe}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unpackBits(tt.src)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("unpackBits(% x) = % x, want an error", tt.src, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unpackBits(% x): %v", tt.src, err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("unpackBits(% x) = % x, want % x", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+// rasterLine RLENGTH 数据中的一行
+func rasterLine(kind byte, data ...byte) []byte {
+	return append([]byte{kind, byte(len(data)), byte(len(data) >> 8)}, data...)
+}
+
+func TestDecodeRLENGTHGray(t *testing.T) {
+	var data []byte
+	data = append(data, rasterLine(rasterLineGray, 0x00, 0x80, 0xff)...)
+	// 压缩的行：重复 3 次 0x10
+	data = append(data, rasterLine(rasterLineGray|rasterCompressed, 0xfe, 0x10)...)
+
+	img, err := DecodeRLENGTH(bytes.NewReader(data), PixelFormatGray)
+	if err != nil {
+		t.Fatalf("DecodeRLENGTH: %v", err)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("image is %T, want *image.Gray", img)
+	}
+	if gray.Rect != image.Rect(0, 0, 3, 2) {
+		t.Fatalf("bounds %v, want 3x2", gray.Rect)
+	}
+	want := []byte{0x00, 0x80, 0xff, 0x10, 0x10, 0x10}
+	if !bytes.Equal(gray.Pix, want) {
+		t.Errorf("pixels % x, want % x", gray.Pix, want)
+	}
+}
+
+func TestDecodeRLENGTHColor(t *testing.T) {
+	var data []byte
+	data = append(data, rasterLine(rasterLineRed, 0x01, 0x02)...)
+	data = append(data, rasterLine(rasterLineGreen|rasterCompressed, 0xff, 0x03)...)
+	data = append(data, rasterLine(rasterLineBlue, 0x04, 0x05)...)
+
+	img, err := DecodeRLENGTH(bytes.NewReader(data), PixelFormatRGB)
+	if err != nil {
+		t.Fatalf("DecodeRLENGTH: %v", err)
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		t.Fatalf("image is %T, want *image.RGBA", img)
+	}
+	want := []byte{0x01, 0x03, 0x04, 0xff, 0x02, 0x03, 0x05, 0xff}
+	if !bytes.Equal(rgba.Pix, want) {
+		t.Errorf("pixels % x, want % x", rgba.Pix, want)
+	}
+}
+
+func TestDecodeRLENGTHInvalid(t *testing.T) {
+	line := rasterLine(rasterLineGray, 0x01, 0x02, 0x03)
+	tests := []struct {
+		name   string
+		data   []byte
+		target error
+	}{
+		{name: "empty"},
+		{name: "truncated header", data: line[:2], target: io.ErrUnexpectedEOF},
+		{name: "truncated line", data: line[:len(line)-1], target: io.ErrUnexpectedEOF},
+		{name: "truncated run", data: rasterLine(rasterLineGray|rasterCompressed, 0x02, 0x01)},
+		{name: "unknown type", data: rasterLine(0x50, 0x01)},
+		{name: "planes differ", data: append(rasterLine(rasterLineRed, 0x01), rasterLine(rasterLineBlue, 0x01, 0x02)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeRLENGTH(bytes.NewReader(tt.data), PixelFormatGray)
+			if err == nil {
+				t.Fatal("DecodeRLENGTH succeeded, want an error")
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Errorf("error %v, want %v", err, tt.target)
+			}
+		})
+	}
+}
+
+func TestOrientJPEG(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 8))
+	img.Set(0, 0, color.White)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	oriented, err := orientJPEG(buf.Bytes(), exifRotate180)
+	if err != nil {
+		t.Fatalf("orientJPEG: %v", err)
+	}
+	exif := []byte{0xff, 0xe1, 0x00, 0x22, 'E', 'x', 'i', 'f', 0x00, 0x00}
+	i := bytes.Index(oriented, exif)
+	if i < 0 {
+		t.Fatal("no EXIF segment")
+	}
+	// 插入的段之外和原数据相同，图像数据没有重新编码
+	rest := append(bytes.Clone(oriented[:i]), oriented[i+2+0x22:]...)
+	if !bytes.Equal(rest, buf.Bytes()) {
+		t.Error("image data changed")
+	}
+	if orientation := oriented[i+28 : i+30]; !bytes.Equal(orientation, []byte{0x00, exifRotate180}) {
+		t.Errorf("orientation % x, want 00 03", orientation)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(oriented)); err != nil {
+		t.Errorf("decode oriented image: %v", err)
+	}
+
+	if _, err := orientJPEG([]byte{0x89, 'P', 'N', 'G'}, exifRotate180); err == nil {
+		t.Error("orientJPEG accepted a PNG")
+	}
+}
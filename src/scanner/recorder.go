@@ -0,0 +1,284 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/gousb"
+)
+
+// RecordOp 录制文件中的操作类型
+type RecordOp string
+
+const (
+	RecordControl RecordOp = "control"
+	RecordWrite   RecordOp = "write"
+	RecordRead    RecordOp = "read"
+)
+
+// recordErrors 录制时按类型保存的错误，回放时还原为对应的错误，便于 isTransient 等判断
+var recordErrors = []struct {
+	kind string
+	err  error
+}{
+	{"stall", gousb.TransferStall},
+	{"pipe", gousb.ErrorPipe},
+	{"interrupted", gousb.ErrorInterrupted},
+	{"no_device", gousb.ErrorNoDevice},
+	{"timeout", context.DeadlineExceeded},
+}
+
+// RecordEntry 录制文件中的一次USB传输，每行一个 JSON 对象
+type RecordEntry struct {
+	Time time.Time
+	Op   RecordOp
+	// 仅控制传输使用
+	RequestType uint8
+	Request     uint8
+	Value       uint16
+	Index       uint16
+	// Data 十六进制的数据，写入为发送的命令，读取和控制传输为设备返回的数据
+	Data  string
+	Error string
+	// ErrorKind 错误的类型，见 recordErrors，其他错误为空
+	ErrorKind string `json:",omitempty"`
+}
+
+var _ Transport = (*RecordingTransport)(nil)
+
+// RecordingTransport 将经过的每次传输写入录制文件，用于复现用户现场的问题
+type RecordingTransport struct {
+	transport Transport
+
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func NewRecordingTransport(transport Transport, w io.WriteCloser) *RecordingTransport {
+	return &RecordingTransport{
+		transport: transport,
+		w:         w,
+		enc:       json.NewEncoder(w),
+	}
+}
+
+// createRecording 在 dir 中为一次连接创建录制文件
+func createRecording(dir string, usb DeviceInfo) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%04x_%04x.jsonl", time.Now().Format("20060102T150405.000"), usb.ParseVendorID(), usb.ParseProductID())
+	return os.Create(filepath.Join(dir, name))
+}
+
+func (r *RecordingTransport) Control(ctx context.Context, rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	n, err := r.transport.Control(ctx, rType, request, val, idx, data)
+	r.record(RecordEntry{
+		Op:          RecordControl,
+		RequestType: rType,
+		Request:     request,
+		Value:       val,
+		Index:       idx,
+		Data:        hex.EncodeToString(data[:max(n, 0)]),
+	}, err)
+	return n, err
+}
+
+func (r *RecordingTransport) Write(ctx context.Context, p []byte) (int, error) {
+	n, err := r.transport.Write(ctx, p)
+	r.record(RecordEntry{Op: RecordWrite, Data: hex.EncodeToString(p)}, err)
+	return n, err
+}
+
+func (r *RecordingTransport) Read(ctx context.Context, p []byte) (int, error) {
+	n, err := r.transport.Read(ctx, p)
+	r.record(RecordEntry{Op: RecordRead, Data: hex.EncodeToString(p[:max(n, 0)])}, err)
+	return n, err
+}
+
+func (r *RecordingTransport) Close() error {
+	err := r.transport.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cerr := r.w.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("close recording: %w", cerr)
+	}
+	return err
+}
+
+func (r *RecordingTransport) record(entry RecordEntry, err error) {
+	entry.Time = time.Now()
+	if err != nil {
+		entry.Error = err.Error()
+		for _, known := range recordErrors {
+			if errors.Is(err, known.err) {
+				entry.ErrorKind = known.kind
+				break
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// 录制失败不影响扫描
+	_ = r.enc.Encode(entry)
+}
+
+var _ Transport = (*ReplayTransport)(nil)
+
+// ReplayTransport 按顺序回放录制文件，发送的命令和录制时不一致时返回错误
+type ReplayTransport struct {
+	mu      sync.Mutex
+	entries []RecordEntry
+	// pending 上一次读取没有取完的数据
+	pending []byte
+}
+
+// NewReplayTransport 读取 RecordingTransport 生成的录制文件
+func NewReplayTransport(r io.Reader) (*ReplayTransport, error) {
+	replay := &ReplayTransport{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry RecordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		replay.entries = append(replay.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return replay, nil
+}
+
+func (r *ReplayTransport) Control(ctx context.Context, rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, err := r.next(RecordControl)
+	if err != nil {
+		return 0, err
+	}
+	if entry.RequestType != rType || entry.Request != request || entry.Value != val || entry.Index != idx {
+		return 0, fmt.Errorf("replay: control transfer %02x/%d differs from recording %02x/%d", rType, request, entry.RequestType, entry.Request)
+	}
+	recorded, err := entry.data()
+	if err != nil {
+		return 0, err
+	}
+	return copy(data, recorded), entry.err()
+}
+
+func (r *ReplayTransport) Write(ctx context.Context, p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, err := r.next(RecordWrite)
+	if err != nil {
+		return 0, err
+	}
+	recorded, err := entry.data()
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(recorded, p) {
+		return 0, fmt.Errorf("replay: command %q differs from recording %q", p, recorded)
+	}
+	if err := entry.err(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (r *ReplayTransport) Read(ctx context.Context, p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.pending) == 0 {
+		entry, err := r.next(RecordRead)
+		if err != nil {
+			return 0, err
+		}
+		if err := entry.err(); err != nil {
+			return 0, err
+		}
+		if r.pending, err = entry.data(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *ReplayTransport) Close() error {
+	return nil
+}
+
+// next 取出下一次传输，跳过录制时轮询产生的空读取
+func (r *ReplayTransport) next(op RecordOp) (RecordEntry, error) {
+	for len(r.entries) > 0 {
+		entry := r.entries[0]
+		r.entries = r.entries[1:]
+		if op != RecordRead && entry.Op == RecordRead && entry.Data == "" && entry.Error == "" {
+			continue
+		}
+		if entry.Op != op {
+			return entry, fmt.Errorf("replay: %s does not match recorded %s at %s", op, entry.Op, entry.Time.Format(time.RFC3339Nano))
+		}
+		return entry, nil
+	}
+	return RecordEntry{}, fmt.Errorf("replay: %s after end of recording: %w", op, io.EOF)
+}
+
+// recordedError 录制时的错误，错误信息和录制时相同
+type recordedError struct {
+	text string
+	err  error
+}
+
+func (e *recordedError) Error() string {
+	return e.text
+}
+
+func (e *recordedError) Unwrap() error {
+	return e.err
+}
+
+func (entry RecordEntry) data() ([]byte, error) {
+	data, err := hex.DecodeString(entry.Data)
+	if err != nil {
+		return nil, fmt.Errorf("replay: corrupt data at %s: %w", entry.Time.Format(time.RFC3339Nano), err)
+	}
+	return data, nil
+}
+
+// err 还原录制时的错误，已知类型的错误可以用 errors.Is 判断，设备被拔出同时为 ErrDeviceGone，
+// 没有 ErrorKind 的错误只保留错误信息
+func (entry RecordEntry) err() error {
+	if entry.Error == "" {
+		return nil
+	}
+	for _, known := range recordErrors {
+		if entry.ErrorKind == known.kind {
+			return deviceGone(&recordedError{text: entry.Error, err: known.err})
+		}
+	}
+	return errors.New(entry.Error)
+}
@@ -0,0 +1,128 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/gousb"
+)
+
+// bufferCloser 录制到内存中
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+// flakyTransport 第 n 次读取返回 err 一次，模拟现场的 USB 错误
+type flakyTransport struct {
+	Transport
+	reads int
+	fail  map[int]error
+}
+
+func (f *flakyTransport) Read(ctx context.Context, p []byte) (int, error) {
+	f.reads++
+	if err, ok := f.fail[f.reads]; ok {
+		return 0, err
+	}
+	return f.Transport.Read(ctx, p)
+}
+
+func TestRecordReplay(t *testing.T) {
+	opts := smallScan(ScanSourceADFDuplex, ScanModeCGRAY)
+	var recording bufferCloser
+
+	recorded := NewTransportScanner(EmulatorDevice, func() (Transport, error) {
+		emulator := &flakyTransport{
+			Transport: NewEmulatorTransport(EmulatorOptions{Sheets: 2}),
+			fail:      map[int]error{2: gousb.TransferStall, 5: gousb.ErrorInterrupted},
+		}
+		return NewRecordingTransport(emulator, &recording), nil
+	}, fastDeviceOptions())
+	want := scanWith(t, recorded, opts)
+
+	replay, err := NewReplayTransport(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatalf("read recording: %v", err)
+	}
+	kinds := map[string]int{}
+	for _, entry := range replay.entries {
+		if entry.Error != "" {
+			kinds[entry.ErrorKind]++
+		}
+	}
+	if kinds["stall"] != 1 || kinds["interrupted"] != 1 || len(kinds) != 2 {
+		t.Errorf("recorded error kinds %v, want one stall and one interrupted", kinds)
+	}
+
+	replayed := NewTransportScanner(EmulatorDevice, func() (Transport, error) {
+		return replay, nil
+	}, fastDeviceOptions())
+	got := scanWith(t, replayed, opts)
+
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d pages, recorded %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i].Data, want[i].Data) {
+			t.Errorf("page %d differs from the recording", i)
+		}
+	}
+}
+
+func scanWith(t *testing.T, scanner *CommonScanner, opts ScanOptions) []Page {
+	t.Helper()
+	ctx := context.Background()
+	if err := scanner.Connect(ctx); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer scanner.Disconnect()
+	pages, err := scanner.ScanPages(ctx, opts)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	return pages
+}
+
+func TestRecordEntryErr(t *testing.T) {
+	tests := []struct {
+		name   string
+		entry  RecordEntry
+		target error
+		gone   bool
+	}{
+		{name: "stall", entry: RecordEntry{Error: "libusb: pipe error", ErrorKind: "stall"}, target: gousb.TransferStall},
+		{name: "pipe", entry: RecordEntry{Error: "libusb: pipe error", ErrorKind: "pipe"}, target: gousb.ErrorPipe},
+		{name: "interrupted", entry: RecordEntry{Error: "interrupted", ErrorKind: "interrupted"}, target: gousb.ErrorInterrupted},
+		{name: "no device", entry: RecordEntry{Error: "no device", ErrorKind: "no_device"}, target: gousb.ErrorNoDevice, gone: true},
+		{name: "timeout", entry: RecordEntry{Error: "context deadline exceeded", ErrorKind: "timeout"}, target: context.DeadlineExceeded},
+		// 没有 ErrorKind 时不按错误信息猜测类型
+		{name: "unknown", entry: RecordEntry{Error: "context deadline exceeded"}},
+		{name: "none", entry: RecordEntry{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.entry.err()
+			if (err != nil) != (tt.entry.Error != "") {
+				t.Fatalf("err() = %v for recorded error %q", err, tt.entry.Error)
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Errorf("err() = %v, want %v", err, tt.target)
+			}
+			if tt.target == nil && errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("err() = %v, want an unknown error", err)
+			}
+			if errors.Is(err, ErrDeviceGone) != tt.gone {
+				t.Errorf("err() = %v, device gone %v", err, !tt.gone)
+			}
+			if isTransient(err) != (tt.name == "stall" || tt.name == "pipe" || tt.name == "interrupted") {
+				t.Errorf("isTransient(%v) = %v", err, isTransient(err))
+			}
+		})
+	}
+}
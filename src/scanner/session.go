@@ -0,0 +1,183 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// ErrSessionBusy 设备正在执行其他扫描任务
+var ErrSessionBusy = errors.New("device is busy with another scan")
+
+// BusyError 设备正忙，Position 为请求排队时的位置，1 表示下一个
+type BusyError struct {
+	Position int
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("%s, queue position %d", ErrSessionBusy, e.Position)
+}
+
+func (e *BusyError) Unwrap() error {
+	return ErrSessionBusy
+}
+
+// DeviceManager 每台设备同一时间只有一个会话，重叠的请求排队或被拒绝
+type DeviceManager struct {
+	opts DeviceOptions
+	// MaxQueue 每台设备最多排队的请求数
+	MaxQueue int
+
+	mu       sync.Mutex
+	sessions map[string]*deviceQueue
+}
+
+// deviceQueue 一台设备的使用者，queue 中的请求按顺序获得设备
+type deviceQueue struct {
+	active bool
+	queue  []chan struct{}
+}
+
+func NewDeviceManager(opts DeviceOptions) *DeviceManager {
+	return &DeviceManager{
+		opts:     opts,
+		MaxQueue: 8,
+		sessions: map[string]*deviceQueue{},
+	}
+}
+
+// Session 对一台设备的独占使用，用完后必须 Close
+type Session struct {
+	Device  DeviceInfo
+	Scanner *CommonScanner
+
+	manager *DeviceManager
+	key     string
+	once    sync.Once
+}
+
+// Acquire 连接设备并独占使用，设备正忙时 wait 为 false 或队列已满返回 *BusyError，
+// 否则排队直到轮到本次请求或 ctx 结束
+func (m *DeviceManager) Acquire(ctx context.Context, device DeviceInfo, wait bool) (*Session, error) {
+	key := deviceKey(device)
+	if err := m.wait(ctx, key, wait); err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		Device:  device,
+		Scanner: NewCommonScanner(device, m.opts),
+		manager: m,
+		key:     key,
+	}
+	markInUse(device, true)
+	if err := session.Scanner.Connect(ctx); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+func (m *DeviceManager) wait(ctx context.Context, key string, wait bool) error {
+	m.mu.Lock()
+	q, ok := m.sessions[key]
+	if !ok {
+		q = &deviceQueue{}
+		m.sessions[key] = q
+	}
+	if !q.active {
+		q.active = true
+		m.mu.Unlock()
+		return nil
+	}
+	if !wait || len(q.queue) >= m.MaxQueue {
+		position := len(q.queue) + 1
+		m.mu.Unlock()
+		return &BusyError{Position: position}
+	}
+	turn := make(chan struct{})
+	q.queue = append(q.queue, turn)
+	m.mu.Unlock()
+
+	select {
+	case <-turn:
+		return nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		i := slices.Index(q.queue, turn)
+		if i >= 0 {
+			q.queue = slices.Delete(q.queue, i, i+1)
+		}
+		m.mu.Unlock()
+		// 取消的同时轮到了本次请求，交给下一个
+		if i < 0 {
+			m.release(key)
+		}
+		return ctx.Err()
+	}
+}
+
+func (m *DeviceManager) release(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.sessions[key]
+	if !ok {
+		return
+	}
+	if len(q.queue) > 0 {
+		next := q.queue[0]
+		q.queue = q.queue[1:]
+		close(next)
+		return
+	}
+	delete(m.sessions, key)
+}
+
+// Close 断开设备并交给下一个排队的请求
+func (s *Session) Close() error {
+	var err error
+	s.once.Do(func() {
+		err = s.Scanner.Disconnect()
+		markInUse(s.Device, false)
+		s.manager.release(s.key)
+	})
+	return err
+}
+
+// deviceKey 按端口路径区分设备，同一台设备无论按序列号还是端口路径选中都是同一个会话，
+// 只有没有端口路径的模拟设备使用 VendorID:ProductID
+func deviceKey(device DeviceInfo) string {
+	if device.Path != "" {
+		return "usb:" + device.Path
+	}
+	return fmt.Sprintf("%04x:%04x", device.ParseVendorID(), device.ParseProductID())
+}
+
+// inUse 正在扫描的设备，按端口路径记录，枚举设备时不打开它们，使用记录的信息
+var inUse = struct {
+	sync.Mutex
+	devices map[string]DeviceInfo
+}{devices: map[string]DeviceInfo{}}
+
+func markInUse(device DeviceInfo, busy bool) {
+	if device.Path == "" {
+		return
+	}
+	inUse.Lock()
+	defer inUse.Unlock()
+	if busy {
+		inUse.devices[device.Path] = device
+	} else {
+		delete(inUse.devices, device.Path)
+	}
+}
+
+func inUseDevice(path string) (DeviceInfo, bool) {
+	inUse.Lock()
+	defer inUse.Unlock()
+	device, ok := inUse.devices[path]
+	return device, ok
+}
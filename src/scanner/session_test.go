@@ -0,0 +1,107 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeviceKey(t *testing.T) {
+	bySerial := DeviceInfo{VendorID: "0x04f9", ProductID: "0x0001", SerialNumber: "E123", Path: "1-1.2"}
+	byPath := DeviceInfo{VendorID: "0x04f9", ProductID: "0x0001", Path: "1-1.2"}
+	if deviceKey(bySerial) != deviceKey(byPath) {
+		t.Errorf("the same port has keys %q and %q", deviceKey(bySerial), deviceKey(byPath))
+	}
+	other := byPath
+	other.Path = "1-1.3"
+	if deviceKey(other) == deviceKey(byPath) {
+		t.Errorf("different ports share the key %q", deviceKey(other))
+	}
+	if key := deviceKey(EmulatorDevice); key != "0000:7206" {
+		t.Errorf("emulator key %q, want 0000:7206", key)
+	}
+}
+
+func TestDeviceManagerQueue(t *testing.T) {
+	Emulator = &EmulatorOptions{}
+	defer func() { Emulator = nil }()
+	manager := NewDeviceManager(fastDeviceOptions())
+	manager.MaxQueue = 1
+	ctx := context.Background()
+
+	first, err := manager.Acquire(ctx, EmulatorDevice, false)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	var busy *BusyError
+	if _, err := manager.Acquire(ctx, EmulatorDevice, false); !errors.As(err, &busy) || busy.Position != 1 {
+		t.Fatalf("second acquire: %v, want busy at position 1", err)
+	}
+
+	// 排队的请求在第一个会话结束后获得设备
+	acquired := make(chan *Session)
+	go func() {
+		session, err := manager.Acquire(ctx, EmulatorDevice, true)
+		if err != nil {
+			t.Errorf("queued acquire: %v", err)
+		}
+		acquired <- session
+	}()
+	for deadline := time.Now().Add(time.Second); queued(manager, EmulatorDevice) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the request never joined the queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := manager.Acquire(ctx, EmulatorDevice, true); !errors.As(err, &busy) || busy.Position != 2 {
+		t.Fatalf("acquire with a full queue: %v, want busy at position 2", err)
+	}
+	first.Close()
+
+	select {
+	case second := <-acquired:
+		if second == nil {
+			t.Fatal("queued acquire failed")
+		}
+		second.Close()
+	case <-time.After(time.Second):
+		t.Fatal("queued request did not get the device")
+	}
+	if len(manager.sessions) != 0 {
+		t.Errorf("%d sessions left after all were closed", len(manager.sessions))
+	}
+}
+
+// queued 排队等待设备的请求数
+func queued(m *DeviceManager, device DeviceInfo) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if q, ok := m.sessions[deviceKey(device)]; ok {
+		return len(q.queue)
+	}
+	return 0
+}
+
+func TestDeviceManagerCancelQueued(t *testing.T) {
+	Emulator = &EmulatorOptions{}
+	defer func() { Emulator = nil }()
+	manager := NewDeviceManager(fastDeviceOptions())
+
+	first, err := manager.Acquire(context.Background(), EmulatorDevice, false)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := manager.Acquire(ctx, EmulatorDevice, true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("queued acquire: %v, want deadline exceeded", err)
+	}
+	if queued(manager, EmulatorDevice) != 0 {
+		t.Errorf("canceled request is still queued")
+	}
+	first.Close()
+	if len(manager.sessions) != 0 {
+		t.Errorf("%d sessions left after all were closed", len(manager.sessions))
+	}
+}
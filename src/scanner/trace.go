@@ -0,0 +1,74 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// LevelTrace 协议跟踪日志的级别，低于 Debug，日志处理器的级别不高于它时才会输出
+const LevelTrace = slog.LevelDebug - 4
+
+// traceHexLimit 跟踪日志中十六进制数据最多显示的字节数
+const traceHexLimit = 32
+
+var commandNames = map[byte]string{
+	'Q': "query capabilities",
+	'I': "negotiate",
+	'D': "select source",
+	'X': "start scan",
+	'R': "abort",
+}
+
+func tracing(ctx context.Context) bool {
+	return slog.Default().Enabled(ctx, LevelTrace)
+}
+
+// traceCommand 记录发送的命令及其参数，例如 ESC X 的 R=、M=、A=
+func traceCommand(ctx context.Context, cmd []byte) {
+	if !tracing(ctx) {
+		return
+	}
+	if len(cmd) < 3 || cmd[0] != 0x1b {
+		slog.LogAttrs(ctx, LevelTrace, "-> command", slog.String("hex", traceHex(cmd)))
+		return
+	}
+
+	attrs := []slog.Attr{}
+	body := strings.TrimSpace(string(bytes.TrimSuffix(cmd[2:], []byte{0x80})))
+	for _, field := range strings.Split(body, "\n") {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			attrs = append(attrs, slog.String(key, value))
+		} else if field != "" {
+			attrs = append(attrs, slog.String("arg", field))
+		}
+	}
+	attrs = append(attrs, slog.String("hex", traceHex(cmd)))
+	slog.LogAttrs(ctx, LevelTrace, fmt.Sprintf("-> ESC %c %s", cmd[1], commandNames[cmd[1]]), attrs...)
+}
+
+// traceResponse 记录设备的响应
+func traceResponse(ctx context.Context, msg string, data []byte) {
+	if !tracing(ctx) {
+		return
+	}
+	slog.LogAttrs(ctx, LevelTrace, "<- "+msg, slog.Int("len", len(data)), slog.String("hex", traceHex(data)))
+}
+
+// traceError 记录失败的传输
+func traceError(ctx context.Context, msg string, err error) {
+	if !tracing(ctx) {
+		return
+	}
+	slog.LogAttrs(ctx, LevelTrace, "<- "+msg+" failed", slog.String("error", err.Error()))
+}
+
+// traceHex 截断过长的数据
+func traceHex(data []byte) string {
+	if len(data) <= traceHexLimit {
+		return fmt.Sprintf("% x", data)
+	}
+	return fmt.Sprintf("% x ... (%d bytes)", data[:traceHexLimit], len(data))
+}
@@ -0,0 +1,16 @@
+package scanner
+
+import "context"
+
+// Transport 扫描仪的USB传输层，CommonScanner 只通过它与设备通信，
+// 默认实现为基于 gousb 的 DeviceState，也可以替换为内存中的模拟设备
+type Transport interface {
+	// Control 控制传输
+	Control(ctx context.Context, rType, request uint8, val, idx uint16, data []byte) (int, error)
+	// Write 批量写入 OUT 端点
+	Write(ctx context.Context, p []byte) (int, error)
+	// Read 批量读取 IN 端点，设备没有数据时可以返回 0
+	Read(ctx context.Context, p []byte) (int, error)
+	// Close 释放设备
+	Close() error
+}
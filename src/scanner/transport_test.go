@@ -0,0 +1,108 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+var _ Transport = (*fakeTransport)(nil)
+
+// fakeControl 一次控制传输
+type fakeControl struct {
+	RequestType uint8
+	Request     uint8
+	Value       uint16
+	Index       uint16
+}
+
+// fakeTransport 按脚本回复的传输层，记录所有控制传输和写入的命令，
+// 每次读取返回 replies 中的下一个数据包，用完后返回 0
+type fakeTransport struct {
+	mu       sync.Mutex
+	replies  [][]byte
+	errs     map[int]error
+	controls []fakeControl
+	writes   [][]byte
+	reads    int
+	closed   bool
+}
+
+func newFakeTransport(replies ...[]byte) *fakeTransport {
+	return &fakeTransport{replies: replies, errs: map[int]error{}}
+}
+
+// failRead 第 n 次读取（从 0 开始）返回 err，不消耗回复
+func (f *fakeTransport) failRead(n int, err error) *fakeTransport {
+	f.errs[n] = err
+	return f
+}
+
+func (f *fakeTransport) Control(ctx context.Context, rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.controls = append(f.controls, fakeControl{rType, request, val, idx})
+	return len(data), nil
+}
+
+func (f *fakeTransport) Write(ctx context.Context, p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes = append(f.writes, bytes.Clone(p))
+	return len(p), nil
+}
+
+func (f *fakeTransport) Read(ctx context.Context, p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.reads
+	f.reads++
+	if err, ok := f.errs[n]; ok {
+		return 0, err
+	}
+	if len(f.replies) == 0 {
+		return 0, nil
+	}
+	copied := copy(p, f.replies[0])
+	if copied < len(f.replies[0]) {
+		f.replies[0] = f.replies[0][copied:]
+	} else {
+		f.replies = f.replies[1:]
+	}
+	return copied, nil
+}
+
+func (f *fakeTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// requests 控制传输的 bRequest 序列
+func (f *fakeTransport) requests() []uint8 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := make([]uint8, len(f.controls))
+	for i, control := range f.controls {
+		requests[i] = control.Request
+	}
+	return requests
+}
+
+// fastDeviceOptions 重试和轮询没有等待
+func fastDeviceOptions() DeviceOptions {
+	opts := DefaultDeviceOptions
+	opts.Timing.Backoff = 1
+	opts.Timing.PollInterval = 1
+	return opts
+}
+
+// newFakeScanner 连接到 transport 的扫描仪
+func newFakeScanner(transport *fakeTransport) *CommonScanner {
+	scanner := NewTransportScanner(DeviceInfo{}, func() (Transport, error) {
+		return transport, nil
+	}, fastDeviceOptions())
+	scanner.transport = transport
+	return scanner
+}
@@ -0,0 +1,187 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/gousb"
+)
+
+// DeviceEventType 设备事件类型
+type DeviceEventType string
+
+const (
+	DeviceAttached DeviceEventType = "ATTACHED"
+	DeviceDetached DeviceEventType = "DETACHED"
+)
+
+// DeviceEvent 扫描仪插入或拔出，Devices 为变化后的设备清单
+type DeviceEvent struct {
+	Type    DeviceEventType
+	Device  DeviceInfo
+	Devices []DeviceInfo
+}
+
+// DeviceWatcher 在后台轮询USB总线，维护扫描仪清单并通知订阅者。
+// gousb 不支持 libusb 的热插拔回调，因此只比较描述符，总线变化时才重新读取扫描仪信息
+type DeviceWatcher struct {
+	interval time.Duration
+	// listBus 和 listDevices 读取总线和扫描仪清单，测试时替换
+	listBus     func() ([]string, error)
+	listDevices func() []DeviceInfo
+
+	mu          sync.RWMutex
+	devices     []DeviceInfo
+	bus         []string
+	subscribers map[chan DeviceEvent]struct{}
+}
+
+func NewDeviceWatcher(interval time.Duration) *DeviceWatcher {
+	return &DeviceWatcher{
+		interval:    interval,
+		listBus:     listBus,
+		listDevices: ListUSBDevice,
+		subscribers: map[chan DeviceEvent]struct{}{},
+	}
+}
+
+// Run 轮询直到 ctx 结束
+func (w *DeviceWatcher) Run(ctx context.Context) {
+	w.poll()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+// Devices 当前的扫描仪清单
+func (w *DeviceWatcher) Devices() []DeviceInfo {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return slices.Clone(w.devices)
+}
+
+// Subscribe 订阅设备事件，处理不及时的事件会被丢弃，调用返回的函数取消订阅
+func (w *DeviceWatcher) Subscribe() (<-chan DeviceEvent, func()) {
+	events := make(chan DeviceEvent, 16)
+
+	w.mu.Lock()
+	w.subscribers[events] = struct{}{}
+	w.mu.Unlock()
+
+	return events, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.subscribers[events]; ok {
+			delete(w.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// WatchDevice 返回的上下文在设备拔出时以 ErrDeviceGone 取消，用于尽快结束进行中的扫描
+func (w *DeviceWatcher) WatchDevice(ctx context.Context, info DeviceInfo) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	events, unsubscribe := w.Subscribe()
+
+	go func() {
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-events:
+				if event.Type == DeviceDetached && !w.present(info) {
+					cancel(fmt.Errorf("%s: %w", info.ID, ErrDeviceGone))
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+func (w *DeviceWatcher) present(info DeviceInfo) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return slices.ContainsFunc(w.devices, info.Matches)
+}
+
+// Matches 是否为 info 指定的设备，序列号和端口路径为空时不比较
+func (info DeviceInfo) Matches(device DeviceInfo) bool {
+	return info.ParseVendorID() == device.ParseVendorID() &&
+		info.ParseProductID() == device.ParseProductID() &&
+		(info.SerialNumber == "" || info.SerialNumber == device.SerialNumber) &&
+		(info.Path == "" || info.Path == device.Path)
+}
+
+func (w *DeviceWatcher) poll() {
+	bus, err := w.listBus()
+	if err != nil {
+		slog.Warn("poll usb bus", "error", err)
+		return
+	}
+
+	w.mu.RLock()
+	changed := !slices.Equal(bus, w.bus)
+	w.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	devices := w.listDevices()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var events []DeviceEvent
+	for _, device := range devices {
+		if !slices.ContainsFunc(w.devices, func(d DeviceInfo) bool { return d.ID == device.ID }) {
+			events = append(events, DeviceEvent{Type: DeviceAttached, Device: device})
+		}
+	}
+	for _, device := range w.devices {
+		if !slices.ContainsFunc(devices, func(d DeviceInfo) bool { return d.ID == device.ID }) {
+			events = append(events, DeviceEvent{Type: DeviceDetached, Device: device})
+		}
+	}
+	w.bus = bus
+	w.devices = devices
+
+	for _, event := range events {
+		slog.Info("usb device "+string(event.Type), "device", event.Device.ID, "name", event.Device.Name)
+		event.Devices = slices.Clone(devices)
+		for subscriber := range w.subscribers {
+			select {
+			case subscriber <- event:
+			default:
+			}
+		}
+	}
+}
+
+// listBus 总线上所有设备的型号和端口，只读取描述符，不打开设备
+func listBus() ([]string, error) {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+
+	var bus []string
+	_, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		bus = append(bus, fmt.Sprintf("%s:%s@%s", desc.Vendor, desc.Product, usbPath(desc)))
+		return false
+	})
+	slices.Sort(bus)
+	return bus, err
+}
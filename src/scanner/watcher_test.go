@@ -0,0 +1,128 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeBus 替换 DeviceWatcher 读取的USB总线
+type fakeBus struct {
+	devices []DeviceInfo
+	// listed 读取扫描仪清单的次数
+	listed int
+}
+
+func (b *fakeBus) attach(serial, path string) {
+	b.devices = append(b.devices, DeviceInfo{
+		ID: "04f9:0001", VendorID: "0x04f9", ProductID: "0x0001", SerialNumber: serial, Path: path,
+	})
+}
+
+func (b *fakeBus) detach(path string) {
+	b.devices = slices.DeleteFunc(b.devices, func(d DeviceInfo) bool { return d.Path == path })
+}
+
+func (b *fakeBus) bus() ([]string, error) {
+	var bus []string
+	for _, d := range b.devices {
+		bus = append(bus, fmt.Sprintf("%s:%s@%s", d.VendorID, d.ProductID, d.Path))
+	}
+	slices.Sort(bus)
+	return bus, nil
+}
+
+func (b *fakeBus) list() []DeviceInfo {
+	b.listed++
+	devices := slices.Clone(b.devices)
+	assignIDs(devices)
+	return devices
+}
+
+func newFakeWatcher(bus *fakeBus) *DeviceWatcher {
+	w := NewDeviceWatcher(time.Hour)
+	w.listBus = bus.bus
+	w.listDevices = bus.list
+	return w
+}
+
+// drain 取出已推送的事件
+func drain(events <-chan DeviceEvent) []string {
+	var got []string
+	for {
+		select {
+		case event := <-events:
+			got = append(got, string(event.Type)+" "+event.Device.ID)
+		default:
+			return got
+		}
+	}
+}
+
+func TestDeviceWatcherPoll(t *testing.T) {
+	bus := &fakeBus{}
+	w := newFakeWatcher(bus)
+	events, unsubscribe := w.Subscribe()
+	defer unsubscribe()
+
+	steps := []struct {
+		name   string
+		change func()
+		events []string
+	}{
+		{"attach", func() { bus.attach("E123", "1-1") }, []string{"ATTACHED 04f9:0001@E123"}},
+		{"unchanged", func() {}, nil},
+		{"second unit", func() { bus.attach("", "1-2") }, []string{"ATTACHED 04f9:0001@usb:1-2"}},
+		{"detach", func() { bus.detach("1-1") }, []string{"DETACHED 04f9:0001@E123"}},
+		// 插到另一个端口，序列号不变，ID 也不变
+		{"re-attach", func() { bus.attach("E123", "1-3") }, []string{"ATTACHED 04f9:0001@E123"}},
+	}
+	for _, step := range steps {
+		listed := bus.listed
+		step.change()
+		w.poll()
+		if got := drain(events); !slices.Equal(got, step.events) {
+			t.Errorf("%s: events %v, want %v", step.name, got, step.events)
+		}
+		if step.events == nil && bus.listed != listed {
+			t.Errorf("%s: device list read although the bus did not change", step.name)
+		}
+	}
+	if devices := w.Devices(); len(devices) != 2 || devices[1].Path != "1-3" {
+		t.Errorf("devices %+v, want the units at 1-2 and 1-3", devices)
+	}
+}
+
+func TestWatchDevice(t *testing.T) {
+	bus := &fakeBus{}
+	bus.attach("E123", "1-1")
+	bus.attach("E456", "1-2")
+	w := newFakeWatcher(bus)
+	w.poll()
+
+	ctx, cancel := w.WatchDevice(context.Background(), w.Devices()[0])
+	defer cancel()
+
+	// 拔出另一台设备不影响
+	bus.detach("1-2")
+	w.poll()
+	select {
+	case <-ctx.Done():
+		t.Fatalf("canceled when another device was detached: %v", context.Cause(ctx))
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	bus.detach("1-1")
+	w.poll()
+	select {
+	case <-ctx.Done():
+		if cause := context.Cause(ctx); !errors.Is(cause, ErrDeviceGone) {
+			t.Errorf("cause %v, want %v", cause, ErrDeviceGone)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not canceled after the device was detached")
+	}
+}
@@ -0,0 +1,63 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"scanner/src/scanner"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LogLevel 日志级别，可在运行时通过管理接口切换协议跟踪日志
+var LogLevel = new(slog.LevelVar)
+
+// TraceReq 协议跟踪日志开关
+type TraceReq struct {
+	Enabled bool
+}
+
+func AddAdminRoutes(r *gin.RouterGroup) {
+	r.Group("/api/admin", localOnly).
+		GET("/trace", GetTrace).
+		POST("/trace", SetTrace)
+}
+
+// localOnly 管理接口只接受本机的请求，按连接的地址判断，不信任 X-Forwarded-For
+func localOnly(ctx *gin.Context) {
+	host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		RenderError(ctx, fmt.Errorf("admin api is only available from localhost"), http.StatusForbidden, nil)
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
+
+// EnableTrace 开启或关闭协议跟踪日志
+func EnableTrace(enabled bool) {
+	if enabled {
+		LogLevel.Set(scanner.LevelTrace)
+	} else {
+		LogLevel.Set(slog.LevelInfo)
+	}
+}
+
+// GetTrace 查看协议跟踪日志是否开启
+func GetTrace(ctx *gin.Context) {
+	RenderSuccess(ctx, TraceReq{Enabled: LogLevel.Level() <= scanner.LevelTrace})
+}
+
+// SetTrace 无需重启即可开启协议跟踪日志，用于排查设备问题
+func SetTrace(ctx *gin.Context) {
+	var req TraceReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		RenderError(ctx, err, http.StatusBadRequest, nil)
+		return
+	}
+
+	EnableTrace(req.Enabled)
+	slog.Info("protocol trace switched", "enabled", req.Enabled)
+	RenderSuccess(ctx, req)
+}
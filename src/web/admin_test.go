@@ -0,0 +1,39 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminLocalOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := Routes(AddAdminRoutes)
+	defer EnableTrace(false)
+
+	tests := []struct {
+		remote string
+		status int
+	}{
+		{"127.0.0.1:40000", http.StatusOK},
+		{"[::1]:40000", http.StatusOK},
+		{"192.168.1.20:40000", http.StatusForbidden},
+		{"[fe80::1]:40000", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remote, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/admin/trace", strings.NewReader(`{"Enabled":true}`))
+			req.RemoteAddr = tt.remote
+			// 代理头不能绕过限制
+			req.Header.Set("X-Forwarded-For", "127.0.0.1")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package web
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -68,11 +70,18 @@ func Routes(custom func(r *gin.RouterGroup)) *gin.Engine {
 	return r
 }
 
-// ListenAndServe 启动一个API服务，stopCh关闭时代表服务关闭
-func ListenAndServe(port string, custom func(r *gin.RouterGroup)) *http.Server {
+// baseContext 服务的上下文，不随请求结束的异步扫描任务也在它结束时中止
+var baseContext = context.Background()
+
+// ListenAndServe 启动一个API服务，ctx结束时所有请求的上下文和异步扫描任务随之取消，进行中的扫描会被中止
+func ListenAndServe(ctx context.Context, port string, custom func(r *gin.RouterGroup)) *http.Server {
+	baseContext = ctx
 	httpServe := &http.Server{
 		Addr:    port,
 		Handler: Routes(custom),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
 	}
 
 	go func() {
@@ -89,6 +98,22 @@ func ListenAndServe(port string, custom func(r *gin.RouterGroup)) *http.Server {
 const (
 	errorCode   = "1"
 	successCode = "0"
+
+	// 设备错误码，前端据此提示用户处理
+	noPaperCode    = "1001"
+	paperJamCode   = "1002"
+	coverOpenCode  = "1003"
+	deviceBusyCode = "1004"
+	timeoutCode    = "1005"
+	deviceGoneCode = "1006"
+
+	// 打开设备失败的错误码
+	permissionCode  = "1007"
+	deviceInUseCode = "1008"
+	notFoundCode    = "1009"
+
+	// 设备正在执行其他扫描任务
+	sessionBusyCode = "1010"
 )
 
 // JSONResponse 默认响应结构
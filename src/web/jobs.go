@@ -0,0 +1,365 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"scanner/src/scanner"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JobState 扫描任务状态
+type JobState string
+
+const (
+	JobQueued   JobState = "QUEUED"   // 等待设备空闲
+	JobRunning  JobState = "RUNNING"  // 正在扫描
+	JobDone     JobState = "DONE"     // 扫描完成，Result 为扫描结果
+	JobFailed   JobState = "FAILED"   // 扫描失败，Error 为失败原因
+	JobCanceled JobState = "CANCELED" // 被取消
+)
+
+// maxJobs 最多保留的任务数，超出时删除最早结束的任务
+const maxJobs = 50
+
+var errJobCanceled = errors.New("job canceled")
+
+// Job 异步扫描任务
+type Job struct {
+	ID    string
+	State JobState
+	Req   *ScanReq
+
+	// Stage 扫描进度的阶段，见 scanner.StageConnecting 等，排队时为空
+	Stage scanner.Stage
+	// Percent 当前页的估计进度，0 到 100
+	Percent int
+	// PagesDone 已完成的页数
+	PagesDone int
+	// BytesReceived 已收到的扫描数据字节数
+	BytesReceived int64
+
+	Result *ScanResp `json:",omitempty"`
+	// Error 失败的原因，Code 和 Help 同设备错误的响应
+	Error string `json:",omitempty"`
+	Code  string `json:",omitempty"`
+	Help  string `json:",omitempty"`
+
+	Created time.Time
+	Updated time.Time
+
+	cancel context.CancelCauseFunc
+	// watchers 订阅任务变化的 JobEvents 请求
+	watchers map[chan struct{}]struct{}
+}
+
+// jobStore 最近的扫描任务，保存在内存中，服务重启后清空
+type jobStore struct {
+	mu   sync.Mutex
+	jobs []*Job
+	// running 还没有结束的 runJob
+	running sync.WaitGroup
+}
+
+var jobs = &jobStore{}
+
+func AddJobRoutes(r *gin.RouterGroup) {
+	r.Group("/api/jobs").
+		POST("", CreateJob).
+		GET("", ListJobs).
+		GET("/:id", GetJob).
+		GET("/:id/events", JobEvents).
+		DELETE("/:id", CancelJob)
+}
+
+// CreateJob 创建扫描任务并立即返回，设备正忙时任务排队等待
+func CreateJob(ctx *gin.Context) {
+	var req ScanReq
+
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		RenderError(ctx, err, http.StatusBadRequest, nil)
+		return
+	}
+	if !prepareScan(ctx, &req) {
+		return
+	}
+
+	job := startJob(&req)
+	RenderSuccess(ctx, jobs.snapshot(job))
+}
+
+// startJob 在后台运行扫描任务，任务不随请求结束，服务停止时中止
+func startJob(req *ScanReq) *Job {
+	ctx, cancel := context.WithCancelCause(baseContext)
+	job := jobs.add(req, cancel)
+	jobs.running.Add(1)
+	go func() {
+		defer jobs.running.Done()
+		runJob(ctx, job)
+	}()
+	return job
+}
+
+// WaitJobs 等待进行中的任务结束，服务停止时调用，使被中止的扫描有时间通知设备停止
+func WaitJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		jobs.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ListJobs 最近的扫描任务，最新的在前
+func ListJobs(ctx *gin.Context) {
+	RenderSuccess(ctx, jobs.list())
+}
+
+// GetJob 查看扫描任务的状态
+func GetJob(ctx *gin.Context) {
+	job, ok := jobs.get(ctx.Param("id"))
+	if !ok {
+		RenderError(ctx, fmt.Errorf("job %s not found", ctx.Param("id")), http.StatusNotFound, nil)
+		return
+	}
+	RenderSuccess(ctx, jobs.snapshot(job))
+}
+
+// JobEvents 通过 SSE 推送任务的进度，事件名为 queued、connecting、negotiating、scanning、
+// page_complete，任务结束时推送 done、failed 或 canceled 后关闭连接。
+// 失败不使用 error 事件，避免和 EventSource 连接出错的 error 事件混淆
+func JobEvents(ctx *gin.Context) {
+	job, ok := jobs.get(ctx.Param("id"))
+	if !ok {
+		RenderError(ctx, fmt.Errorf("job %s not found", ctx.Param("id")), http.StatusNotFound, nil)
+		return
+	}
+	changed, unsubscribe := jobs.watch(job)
+	defer unsubscribe()
+
+	last := jobs.snapshot(job)
+	ctx.SSEvent(last.event(), last)
+	ctx.Writer.Flush()
+	if last.finished() {
+		return
+	}
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case <-changed:
+			current := jobs.snapshot(job)
+			// 只推送阶段、进度或页数的变化，收到的字节数在下一个事件中一起推送
+			if current.State == last.State && current.Stage == last.Stage &&
+				current.Percent == last.Percent && current.PagesDone == last.PagesDone {
+				return true
+			}
+			event := current.event()
+			// 合并的变化中有完成的页时不能丢掉 page_complete
+			if !current.finished() && current.PagesDone != last.PagesDone {
+				event = "page_complete"
+			}
+			last = current
+			ctx.SSEvent(event, current)
+			return !current.finished()
+		case <-heartbeat.C:
+			ctx.SSEvent("ping", "")
+			return true
+		}
+	})
+}
+
+// CancelJob 取消排队或进行中的扫描任务，已结束的任务不受影响
+func CancelJob(ctx *gin.Context) {
+	job, ok := jobs.get(ctx.Param("id"))
+	if !ok {
+		RenderError(ctx, fmt.Errorf("job %s not found", ctx.Param("id")), http.StatusNotFound, nil)
+		return
+	}
+	job.cancel(errJobCanceled)
+	RenderSuccess(ctx, jobs.snapshot(job))
+}
+
+// runJob 在后台执行扫描任务
+func runJob(ctx context.Context, job *Job) {
+	req := job.Req
+	if Watcher != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = Watcher.WatchDevice(ctx, req.Device)
+		defer cancel()
+	}
+
+	ctx = scanner.WithProgress(ctx, func(progress scanner.Progress) {
+		// 保存扫描件后才算完成，结束状态由 finish 记录
+		if progress.Stage == scanner.StageDone || progress.Stage == scanner.StageError {
+			return
+		}
+		jobs.update(job, func(job *Job) {
+			job.State = JobRunning
+			job.Stage = progress.Stage
+			job.Percent = progress.Percent
+			job.PagesDone = progress.Pages
+			job.BytesReceived = progress.Received
+		})
+	})
+
+	session, err := Sessions.Acquire(ctx, req.Device, true)
+	if err != nil {
+		jobs.finish(ctx, job, nil, err)
+		return
+	}
+	defer session.Close()
+
+	pages, err := session.Scanner.ScanPages(ctx, *req.Option)
+	var result *ScanResp
+	if err == nil {
+		result, err = savePages(req, pages)
+	}
+	jobs.finish(ctx, job, result, err)
+}
+
+func (s *jobStore) add(req *ScanReq, cancel context.CancelCauseFunc) *Job {
+	id := make([]byte, 8)
+	rand.Read(id)
+	now := time.Now()
+	job := &Job{
+		ID:       hex.EncodeToString(id),
+		State:    JobQueued,
+		Req:      req,
+		Created:  now,
+		Updated:  now,
+		cancel:   cancel,
+		watchers: map[chan struct{}]struct{}{},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, job)
+	for i := 0; len(s.jobs) > maxJobs && i < len(s.jobs); {
+		if s.jobs[i].finished() {
+			s.jobs = slices.Delete(s.jobs, i, i+1)
+			continue
+		}
+		i++
+	}
+	return job
+}
+
+func (s *jobStore) get(id string) (*Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.jobs, func(job *Job) bool { return job.ID == id })
+	if i < 0 {
+		return nil, false
+	}
+	return s.jobs[i], true
+}
+
+func (s *jobStore) list() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Job, 0, len(s.jobs))
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		list = append(list, *s.jobs[i])
+	}
+	return list
+}
+
+// snapshot 任务的副本，避免序列化时和扫描协程同时访问
+func (s *jobStore) snapshot(job *Job) Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *job
+}
+
+func (s *jobStore) update(job *Job, fn func(job *Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(job)
+	job.Updated = time.Now()
+	for watcher := range job.watchers {
+		// 只通知有变化，读取时取最新的状态，因此处理不及时的通知可以合并
+		select {
+		case watcher <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watch 订阅任务的变化，调用返回的函数取消订阅
+func (s *jobStore) watch(job *Job) (<-chan struct{}, func()) {
+	changed := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.watchers[changed] = struct{}{}
+	return changed, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(job.watchers, changed)
+	}
+}
+
+// finish 记录任务结果，ctx 为任务的上下文，用于区分取消和失败
+func (s *jobStore) finish(ctx context.Context, job *Job, result *ScanResp, err error) {
+	s.update(job, func(job *Job) {
+		switch {
+		case err == nil:
+			job.State = JobDone
+			job.Stage = scanner.StageDone
+			job.Result = result
+		case errors.Is(context.Cause(ctx), errJobCanceled):
+			job.State = JobCanceled
+			job.Error = errJobCanceled.Error()
+		default:
+			_, resp := deviceErrorResponse(err, job.Req.Device)
+			job.State = JobFailed
+			job.Stage = scanner.StageError
+			job.Error = resp.Msg
+			job.Code = resp.Code
+			job.Help = resp.Help
+		}
+	})
+	job.cancel(nil)
+	if err != nil {
+		slog.Warn("scan job ended with error", "job", job.ID, "error", err)
+	}
+}
+
+// event 推送任务进度时使用的事件名
+func (job *Job) event() string {
+	switch {
+	case job.State == JobDone:
+		return "done"
+	case job.State == JobFailed:
+		return "failed"
+	case job.State == JobCanceled:
+		return "canceled"
+	case job.Stage == "":
+		return "queued"
+	default:
+		return strings.ToLower(string(job.Stage))
+	}
+}
+
+func (job *Job) finished() bool {
+	return job.State == JobDone || job.State == JobFailed || job.State == JobCanceled
+}
@@ -0,0 +1,190 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"scanner/src/scanner"
+	"testing"
+	"time"
+)
+
+func newTestJob(s *jobStore) (*Job, context.Context) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	req := &ScanReq{Device: scanner.EmulatorDevice}
+	return s.add(req, cancel), ctx
+}
+
+func TestJobStoreTrim(t *testing.T) {
+	s := &jobStore{}
+	var all []*Job
+	for range maxJobs {
+		job, ctx := newTestJob(s)
+		all = append(all, job)
+		if len(all) <= 10 {
+			s.finish(ctx, job, &ScanResp{}, nil)
+		}
+	}
+	if len(s.jobs) != maxJobs {
+		t.Fatalf("%d jobs, want %d", len(s.jobs), maxJobs)
+	}
+
+	// 超出时先删除最早结束的任务
+	for range 5 {
+		job, _ := newTestJob(s)
+		all = append(all, job)
+	}
+	if len(s.jobs) != maxJobs {
+		t.Fatalf("%d jobs after trimming, want %d", len(s.jobs), maxJobs)
+	}
+	for i, job := range all {
+		_, ok := s.get(job.ID)
+		if want := i >= 5; ok != want {
+			t.Errorf("job %d kept %v, want %v", i, ok, want)
+		}
+	}
+
+	// 未结束的任务不会被删除
+	for range 10 {
+		newTestJob(s)
+	}
+	if len(s.jobs) != maxJobs+5 {
+		t.Errorf("%d jobs, want all %d unfinished jobs and no finished ones", len(s.jobs), maxJobs+5)
+	}
+	if list := s.list(); list[0].ID != s.jobs[len(s.jobs)-1].ID {
+		t.Error("list should start with the newest job")
+	}
+}
+
+func TestJobStoreFinish(t *testing.T) {
+	tests := []struct {
+		name  string
+		cause error
+		err   error
+		state JobState
+		stage scanner.Stage
+		code  string
+		event string
+	}{
+		{name: "done", state: JobDone, stage: scanner.StageDone, event: "done"},
+		{name: "canceled", cause: errJobCanceled, err: context.Canceled, state: JobCanceled, event: "canceled"},
+		{name: "device error", err: fmt.Errorf("scan: %w", scanner.ErrPaperJam), state: JobFailed, stage: scanner.StageError, code: paperJamCode, event: "failed"},
+		{name: "server stopped", cause: context.Canceled, err: context.Canceled, state: JobFailed, stage: scanner.StageError, code: errorCode, event: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &jobStore{}
+			job, ctx := newTestJob(s)
+			if tt.cause != nil {
+				job.cancel(tt.cause)
+			}
+			var result *ScanResp
+			if tt.err == nil {
+				result = &ScanResp{URL: "/api/download/scan.jpg"}
+			}
+			changed, unsubscribe := s.watch(job)
+			defer unsubscribe()
+
+			s.finish(ctx, job, result, tt.err)
+
+			select {
+			case <-changed:
+			default:
+				t.Error("watchers were not notified")
+			}
+			got := s.snapshot(job)
+			if got.State != tt.state || got.Stage != tt.stage || got.Code != tt.code {
+				t.Errorf("state %s, stage %q, code %q, want %s, %q, %q", got.State, got.Stage, got.Code, tt.state, tt.stage, tt.code)
+			}
+			if (got.Result != nil) != (tt.state == JobDone) || (got.Error != "") == (tt.state == JobDone) {
+				t.Errorf("result %v, error %q for state %s", got.Result, got.Error, got.State)
+			}
+			if event := got.event(); event != tt.event || !got.finished() {
+				t.Errorf("event %q, finished %v, want %q", event, got.finished(), tt.event)
+			}
+			if ctx.Err() == nil {
+				t.Error("finish should release the job context")
+			}
+		})
+	}
+}
+
+// startTestJob 在模拟设备上运行扫描任务
+func startTestJob() *Job {
+	opts := scanner.DefaultScanOptions
+	opts.DPI, opts.Width, opts.Height = 75, 50, 40
+	return startJob(&ScanReq{Device: scanner.EmulatorDevice, Option: &opts})
+}
+
+// waitJob 等待任务满足条件
+func waitJob(t *testing.T, job *Job, what string, ok func(Job) bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !ok(jobs.snapshot(job)); {
+		if time.Now().After(deadline) {
+			t.Fatalf("job never %s, state %s", what, jobs.snapshot(job).State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func setupTestJobs(t *testing.T) {
+	scanner.Emulator = &scanner.EmulatorOptions{Sheets: 50, Delay: 5 * time.Millisecond}
+	Sessions = scanner.NewDeviceManager(DeviceOptions)
+	DefaultAttachmentPath = t.TempDir()
+	jobs = &jobStore{}
+	t.Cleanup(func() {
+		scanner.Emulator = nil
+		jobs = &jobStore{}
+		baseContext = context.Background()
+	})
+}
+
+func TestJobCancel(t *testing.T) {
+	setupTestJobs(t)
+
+	running := startTestJob()
+	waitJob(t, running, "started", func(job Job) bool { return job.State == JobRunning })
+	queued := startTestJob()
+	time.Sleep(20 * time.Millisecond)
+	if state := jobs.snapshot(queued).State; state != JobQueued {
+		t.Fatalf("second job is %s, want %s", state, JobQueued)
+	}
+
+	// 取消排队的任务不影响正在扫描的任务
+	queued.cancel(errJobCanceled)
+	waitJob(t, queued, "canceled", func(job Job) bool { return job.finished() })
+	if got := jobs.snapshot(queued); got.State != JobCanceled || got.Stage != "" {
+		t.Errorf("queued job is %s at stage %q, want canceled before it started", got.State, got.Stage)
+	}
+	if state := jobs.snapshot(running).State; state != JobRunning {
+		t.Errorf("running job is %s after canceling the queued one", state)
+	}
+
+	running.cancel(errJobCanceled)
+	waitJob(t, running, "canceled", func(job Job) bool { return job.finished() })
+	if got := jobs.snapshot(running); got.State != JobCanceled || got.Stage == "" {
+		t.Errorf("running job is %s at stage %q, want canceled while scanning", got.State, got.Stage)
+	}
+	if err := WaitJobs(context.Background()); err != nil {
+		t.Errorf("wait jobs: %v", err)
+	}
+}
+
+func TestJobStopsWithServer(t *testing.T) {
+	setupTestJobs(t)
+	server, stop := context.WithCancel(context.Background())
+	defer stop()
+	baseContext = server
+
+	job := startTestJob()
+	waitJob(t, job, "started", func(job Job) bool { return job.State == JobRunning })
+	stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitJobs(ctx); err != nil {
+		t.Fatalf("wait jobs: %v", err)
+	}
+	if got := jobs.snapshot(job); got.State != JobFailed || got.Stage != scanner.StageError {
+		t.Errorf("job is %s at stage %q after the server stopped, want %s", got.State, got.Stage, JobFailed)
+	}
+}
@@ -10,11 +10,69 @@ type DeviceListReq struct {
 type ScanReq struct {
 	Device scanner.DeviceInfo   `json:"device"`
 	Option *scanner.ScanOptions `json:"option"`
+	// Wait 设备正在扫描时排队等待，为 false 时立即返回 409 和排队位置
+	Wait bool `json:"wait"`
+}
+
+// StreamReq 流式扫描参数，GET 使用查询参数，POST 还可以使用表单或 JSON，
+// 为空的参数使用 scanner.DefaultScanOptions 中的值
+type StreamReq struct {
+	// Device 设备ID，为空时使用第一台设备
+	Device     string             `form:"device" json:"device"`
+	DPI        uint16             `form:"dpi" json:"dpi"`
+	Mode       scanner.ScanMode   `form:"mode" json:"mode"`
+	Source     scanner.ScanSource `form:"source" json:"source"`
+	Brightness int                `form:"brightness" json:"brightness"`
+	Contrast   int                `form:"contrast" json:"contrast"`
+	Top        float64            `form:"top" json:"top"`
+	Left       float64            `form:"left" json:"left"`
+	Width      float64            `form:"width" json:"width"`
+	Height     float64            `form:"height" json:"height"`
+	Wait       bool               `form:"wait" json:"wait"`
+}
+
+// scanReq 转换为扫描参数，设备直接输出 JPEG
+func (req StreamReq) scanReq() ScanReq {
+	option := scanner.DefaultScanOptions
+	if req.DPI != 0 {
+		option.DPI = req.DPI
+	}
+	if req.Mode != "" {
+		option.Mode = req.Mode
+	}
+	if req.Source != "" {
+		option.Source = req.Source
+	}
+	if req.Width != 0 {
+		option.Width = req.Width
+	}
+	if req.Height != 0 {
+		option.Height = req.Height
+	}
+	option.Brightness = req.Brightness
+	option.Contrast = req.Contrast
+	option.Top = req.Top
+	option.Left = req.Left
+	option.Compression = scanner.CompressionJPEG
+	option.Format = scanner.ImageFormatJPEG
+
+	return ScanReq{
+		Device: scanner.DeviceInfo{ID: req.Device},
+		Option: &option,
+		Wait:   req.Wait,
+	}
+}
+
+// BusyResp 设备正忙时返回的排队位置，1 表示下一个
+type BusyResp struct {
+	Position int
 }
 
 // ScanResp 扫描结果
 type ScanResp struct {
+	// URL 第一页，Pages 为所有页
 	URL      string
+	Pages    []string
 	FileType string
 
 	Req *ScanReq
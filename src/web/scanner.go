@@ -1,11 +1,16 @@
 package web
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"scanner/src/scanner"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,23 +19,144 @@ import (
 // 扫描件存储位置
 var DefaultAttachmentPath = "./attachment"
 
+// DeviceOptions 连接设备时使用的参数，超时策略可由服务配置覆盖
+var DeviceOptions = scanner.DefaultDeviceOptions
+
+// Watcher 后台维护的扫描仪清单，为 nil 时每次请求都重新枚举USB总线
+var Watcher *scanner.DeviceWatcher
+
+// Sessions 每台设备同一时间只执行一个扫描任务
+var Sessions *scanner.DeviceManager
+
+// capabilities 最近一次查询到的设备能力，设备正在扫描时返回
+var capabilities sync.Map
+
 func AddWebRoutes(r *gin.RouterGroup) {
 	// 确保附件目录存在
 	if _, err := os.Stat(DefaultAttachmentPath); os.IsNotExist(err) {
 		os.MkdirAll(DefaultAttachmentPath, 0755)
 	}
+	Sessions = scanner.NewDeviceManager(DeviceOptions)
 
 	// 先注册API路由
 	r.Group("/api").
 		POST("/scan", Scan).
+		GET("/scan/stream", ScanStream).
+		POST("/scan/stream", ScanStream).
 		GET("/devices", ListUSBDevice).
+		GET("/devices/events", DeviceEvents).
+		GET("/devices/:id", DeviceDetails).
+		GET("/devices/:id/capabilities", Capabilities).
 		GET("/download/:attachID", Download)
+
+	AddJobRoutes(r)
+	AddAdminRoutes(r)
 }
 
-// ListUSBDevice 查看本机所有USB设备
+// ListUSBDevice 查看本机所有扫描仪
 func ListUSBDevice(ctx *gin.Context) {
-	devices := scanner.ListUSBDevice()
-	RenderSuccess(ctx, devices)
+	RenderSuccess(ctx, listDevices())
+}
+
+// listDevices 优先使用 Watcher 维护的清单
+func listDevices() []scanner.DeviceInfo {
+	if Watcher != nil {
+		if devices := Watcher.Devices(); len(devices) > 0 {
+			return devices
+		}
+	}
+	return scanner.ListUSBDevice()
+}
+
+// resolveDevice 在扫描仪清单中找到请求指定的那一台，补全序列号和端口路径，
+// 使同一台设备的请求使用同一个会话
+func resolveDevice(device scanner.DeviceInfo) scanner.DeviceInfo {
+	for _, d := range listDevices() {
+		if device.Matches(d) {
+			return d
+		}
+	}
+	return device
+}
+
+// DeviceEvents 通过 SSE 推送扫描仪插入、拔出事件，连接后先推送一次当前清单
+func DeviceEvents(ctx *gin.Context) {
+	if Watcher == nil {
+		RenderError(ctx, fmt.Errorf("device watcher is disabled"), http.StatusNotImplemented, nil)
+		return
+	}
+	events, unsubscribe := Watcher.Subscribe()
+	defer unsubscribe()
+
+	ctx.SSEvent("devices", listDevices())
+	ctx.Writer.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			ctx.SSEvent(strings.ToLower(string(event.Type)), event)
+			return true
+		case <-heartbeat.C:
+			// 防止代理关闭空闲连接
+			ctx.SSEvent("ping", "")
+			return true
+		}
+	})
+}
+
+// DeviceDetails 查看设备详情，包括匹配的型号参数和选中的扫描接口
+func DeviceDetails(ctx *gin.Context) {
+	device, err := scanner.ParseDeviceID(ctx.Param("id"))
+	if err != nil {
+		RenderError(ctx, err, http.StatusBadRequest, nil)
+		return
+	}
+
+	details, err := scanner.DescribeDevice(resolveDevice(device), DeviceOptions)
+	if err != nil {
+		RenderError(ctx, err, http.StatusNotFound, nil)
+		return
+	}
+
+	RenderSuccess(ctx, details)
+}
+
+// Capabilities 查询设备支持的分辨率、扫描模式等
+func Capabilities(ctx *gin.Context) {
+	device, err := scanner.ParseDeviceID(ctx.Param("id"))
+	if err != nil {
+		RenderError(ctx, err, http.StatusBadRequest, nil)
+		return
+	}
+
+	device = resolveDevice(device)
+	session, err := Sessions.Acquire(ctx.Request.Context(), device, false)
+	if err != nil {
+		// 设备正在扫描时不打断，返回之前查询到的结果
+		if cached, ok := capabilities.Load(device.ID); ok && errors.Is(err, scanner.ErrSessionBusy) {
+			RenderSuccess(ctx, cached)
+			return
+		}
+		renderDeviceError(ctx, err, device)
+		return
+	}
+	defer session.Close()
+
+	caps, err := session.Scanner.Capabilities(ctx.Request.Context())
+	if err != nil {
+		renderScanError(ctx, err)
+		return
+	}
+	capabilities.Store(device.ID, caps)
+
+	RenderSuccess(ctx, caps)
 }
 
 // Scan 执行扫描
@@ -41,58 +167,227 @@ func Scan(ctx *gin.Context) {
 		RenderError(ctx, err, http.StatusBadRequest, nil)
 		return
 	}
-	if req.Option == nil {
-		req.Option = &scanner.DefaultScanOptions
+	if !prepareScan(ctx, &req) {
+		return
 	}
 
-	// 如果没有传入设备信息，尝试使用第一个可用设备
-	if req.Device.VendorID == "" || req.Device.ProductID == "" {
-		devices := scanner.ListUSBDevice()
-		if len(devices) > 0 {
-			req.Device = devices[0]
-		} else {
-			RenderError(ctx, fmt.Errorf("no USB device found"), http.StatusNotFound, nil)
-			return
-		}
+	// 浏览器断开、服务关闭或设备被拔出时取消扫描
+	scanCtx := ctx.Request.Context()
+	if Watcher != nil {
+		var cancel context.CancelFunc
+		scanCtx, cancel = Watcher.WatchDevice(scanCtx, req.Device)
+		defer cancel()
+	}
+
+	// 独占设备，正在扫描时按 req.Wait 排队或拒绝
+	session, err := Sessions.Acquire(scanCtx, req.Device, req.Wait)
+	if err != nil {
+		renderDeviceError(ctx, err, req.Device)
+		return
 	}
+	defer session.Close()
 
-	// 创建M7206扫描器实例
-	scan := scanner.NewCommonScanner(req.Device, scanner.DefaultDeviceOptions)
+	slog.Info("Successfully opened scanner device", "id", req.Device.ID, "vendorID", req.Device.VendorID, "productID", req.Device.ProductID, "serial", req.Device.SerialNumber, "path", req.Device.Path)
 
-	// 初始化USB上下文
-	if err := scan.Connect(); err != nil {
+	// 执行扫描，自动进纸器中的每张纸为一页
+	pages, err := session.Scanner.ScanPages(scanCtx, *req.Option)
+	if err != nil {
+		renderScanError(ctx, err)
+		return
+	}
+	result, err := savePages(&req, pages)
+	if err != nil {
 		RenderError(ctx, err, http.StatusInternalServerError, nil)
 		return
 	}
-	defer scan.Disconnect()
 
-	slog.Info("Successfully opened scanner device", "vendorID", req.Device.VendorID, "productID", req.Device.ProductID)
+	RenderSuccess(ctx, result)
+}
+
+// 流式扫描结束时通过 trailer 返回的结果，Code 同 JSONResponse
+const (
+	scanCodeTrailer  = "X-Scan-Code"
+	scanErrorTrailer = "X-Scan-Error"
+)
+
+// ScanStream 扫描一页，设备发送的 JPEG 数据直接写入响应，不保存文件。
+// 开始输出前的错误和 POST /api/scan 一样返回 JSON，之后的错误只能通过 trailer 返回
+func ScanStream(ctx *gin.Context) {
+	var stream StreamReq
+
+	if err := ctx.ShouldBind(&stream); err != nil {
+		RenderError(ctx, err, http.StatusBadRequest, nil)
+		return
+	}
+	req := stream.scanReq()
+	if !prepareScan(ctx, &req) {
+		return
+	}
+
+	scanCtx := ctx.Request.Context()
+	if Watcher != nil {
+		var cancel context.CancelFunc
+		scanCtx, cancel = Watcher.WatchDevice(scanCtx, req.Device)
+		defer cancel()
+	}
 
-	// 使用getAttachment()创建可重复访问的路径
-	filepath := getAttachment()
-	file, err := os.Create(filepath)
+	session, err := Sessions.Acquire(scanCtx, req.Device, req.Wait)
 	if err != nil {
-		RenderError(ctx, err, http.StatusInternalServerError, nil)
+		renderDeviceError(ctx, err, req.Device)
 		return
 	}
-	defer file.Close()
+	defer session.Close()
 
-	// 执行扫描
-	if err := scan.Scan(file, *req.Option); err != nil {
-		RenderError(ctx, err, http.StatusInternalServerError, nil)
+	out := &streamWriter{ctx: ctx}
+	err = session.Scanner.Scan(scanCtx, out, *req.Option)
+	if !out.started {
+		if err == nil {
+			err = fmt.Errorf("scanner returned no pages")
+		}
+		renderScanError(ctx, err)
 		return
 	}
 
-	// 使用文件名作为attachID
-	attachID := filepath[len(DefaultAttachmentPath)+1:] // 移除前缀路径
+	code, msg := successCode, ""
+	if err != nil {
+		slog.Warn("scan stream failed", "device", req.Device.ID, "error", err)
+		_, resp := deviceErrorResponse(err, req.Device)
+		code, msg = resp.Code, resp.Msg
+	}
+	ctx.Writer.Header().Set(scanCodeTrailer, code)
+	ctx.Writer.Header().Set(scanErrorTrailer, msg)
+}
+
+// streamWriter 收到第一块数据时才发送响应头，每次写入后立即发送给客户端
+type streamWriter struct {
+	ctx     *gin.Context
+	started bool
+}
 
-	result := ScanResp{
-		URL:      fmt.Sprintf("/api/download/%s", attachID),
-		FileType: "jpeg",
-		Req:      &req,
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		header := w.ctx.Writer.Header()
+		header.Set("Content-Type", "image/jpeg")
+		header.Set("Trailer", scanCodeTrailer+", "+scanErrorTrailer)
+		w.ctx.Writer.WriteHeader(http.StatusOK)
 	}
+	n, err := w.ctx.Writer.Write(p)
+	w.ctx.Writer.Flush()
+	return n, err
+}
 
-	RenderSuccess(ctx, result)
+// prepareScan 检查扫描参数并确定使用的设备，参数错误时返回错误响应和 false
+func prepareScan(ctx *gin.Context, req *ScanReq) bool {
+	if req.Option == nil {
+		option := scanner.DefaultScanOptions
+		req.Option = &option
+	}
+	if err := req.Option.Validate(); err != nil {
+		RenderError(ctx, err, http.StatusBadRequest, nil)
+		return false
+	}
+
+	// 只传入设备ID时按ID选择设备，例如 17ef:5629@E12345A6B789012
+	if req.Device.VendorID == "" && req.Device.ID != "" {
+		device, err := scanner.ParseDeviceID(req.Device.ID)
+		if err != nil {
+			RenderError(ctx, err, http.StatusBadRequest, nil)
+			return false
+		}
+		req.Device = device
+	}
+
+	// 如果没有传入设备信息，尝试使用第一个可用设备
+	if req.Device.VendorID == "" || req.Device.ProductID == "" {
+		devices := listDevices()
+		if len(devices) > 0 {
+			req.Device = devices[0]
+		} else {
+			RenderError(ctx, fmt.Errorf("no USB device found"), http.StatusNotFound, nil)
+			return false
+		}
+	} else {
+		req.Device = resolveDevice(req.Device)
+	}
+	return true
+}
+
+// savePages 将扫描结果保存到附件目录
+func savePages(req *ScanReq, pages []scanner.Page) (*ScanResp, error) {
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("scanner returned no pages")
+	}
+
+	result := &ScanResp{
+		FileType: strings.ToLower(string(req.Option.OutputFormat())),
+		Req:      req,
+	}
+	attachmentMu.Lock()
+	defer attachmentMu.Unlock()
+	name := attachmentName(time.Now(), pages[0].Format)
+	for _, page := range pages {
+		// 使用getAttachment()创建可重复访问的路径
+		filepath := getAttachment(name, page.Index, page.Format)
+		if err := os.WriteFile(filepath, page.Data, 0644); err != nil {
+			return nil, err
+		}
+
+		// 使用文件名作为attachID
+		attachID := filepath[len(DefaultAttachmentPath)+1:] // 移除前缀路径
+		result.Pages = append(result.Pages, fmt.Sprintf("/api/download/%s", attachID))
+	}
+	result.URL = result.Pages[0]
+	return result, nil
+}
+
+// deviceErrors 设备错误对应的HTTP状态、错误码和处理提示
+var deviceErrors = []struct {
+	err    error
+	status int
+	code   string
+	help   string
+}{
+	{scanner.ErrNoPaper, http.StatusUnprocessableEntity, noPaperCode, "请在进纸器中放入纸张，或选择平板扫描"},
+	{scanner.ErrPaperJam, http.StatusConflict, paperJamCode, "请打开进纸器取出卡住的纸张后重试"},
+	{scanner.ErrCoverOpen, http.StatusPreconditionFailed, coverOpenCode, "请合上扫描仪盖板后重试"},
+	{scanner.ErrDeviceBusy, http.StatusServiceUnavailable, deviceBusyCode, "设备正忙，请等待当前任务完成后重试"},
+	{scanner.ErrTimeout, http.StatusGatewayTimeout, timeoutCode, "设备长时间无响应，请检查设备连接后重试"},
+	{scanner.ErrDeviceGone, http.StatusGone, deviceGoneCode, "设备已断开，请检查电源和USB连接后重试"},
+	{scanner.ErrPermissionDenied, http.StatusForbidden, permissionCode, "当前用户没有权限访问USB设备"},
+	{scanner.ErrDeviceInUse, http.StatusLocked, deviceInUseCode, "设备正被其他程序占用"},
+	{scanner.ErrDeviceNotFound, http.StatusNotFound, notFoundCode, "没有找到设备"},
+	{scanner.ErrSessionBusy, http.StatusConflict, sessionBusyCode, "设备正在执行其他扫描任务，请稍后重试或排队等待"},
+}
+
+// renderScanError 设备错误返回独立的状态码和错误码，其他错误按服务端错误处理
+func renderScanError(ctx *gin.Context, err error) {
+	renderDeviceError(ctx, err, scanner.DeviceInfo{})
+}
+
+// renderDeviceError 同 renderScanError，打开设备失败时提示中带有该设备的 udev 规则等处理建议
+func renderDeviceError(ctx *gin.Context, err error, device scanner.DeviceInfo) {
+	status, resp := deviceErrorResponse(err, device)
+	resp.RenderJSON(ctx, status)
+}
+
+// deviceErrorResponse 设备错误对应的HTTP状态和响应，其他错误按服务端错误处理
+func deviceErrorResponse(err error, device scanner.DeviceInfo) (int, JSONResponse) {
+	for _, e := range deviceErrors {
+		if errors.Is(err, e.err) {
+			help := e.help
+			if hint := scanner.OpenHint(err, device); hint != "" && device.VendorID != "" {
+				help = hint
+			}
+			resp := JSONResponse{Msg: err.Error(), Code: e.code, Help: help}
+			var busy *scanner.BusyError
+			if errors.As(err, &busy) {
+				resp.Data = BusyResp{Position: busy.Position}
+			}
+			return e.status, resp
+		}
+	}
+	return http.StatusInternalServerError, JSONResponse{Msg: err.Error(), Code: errorCode}
 }
 
 // Download 下载扫描件
@@ -112,6 +407,24 @@ func Download(ctx *gin.Context) {
 	SendData(ctx, attachID, f)
 }
 
-func getAttachment() string {
-	return fmt.Sprintf("%s/%s.jpg", DefaultAttachmentPath, time.Now().Local().Format("20060102T150405"))
+// attachmentMu 保证同一秒完成的扫描任务使用不同的文件名
+var attachmentMu sync.Mutex
+
+// attachmentName 扫描件的文件名，同一秒内已有扫描件时加上序号，例如 20250101T120000_1
+func attachmentName(at time.Time, format scanner.ImageFormat) string {
+	base := at.Local().Format("20060102T150405")
+	name := base
+	for i := 1; ; i++ {
+		if _, err := os.Stat(getAttachment(name, 0, format)); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+}
+
+func getAttachment(name string, page int, format scanner.ImageFormat) string {
+	if page > 0 {
+		name = fmt.Sprintf("%s-%d", name, page+1)
+	}
+	return fmt.Sprintf("%s/%s%s", DefaultAttachmentPath, name, format.Ext())
 }
@@ -0,0 +1,81 @@
+package web
+
+import (
+	"encoding/json"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"scanner/src/scanner"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestScanStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name     string
+		emulator scanner.EmulatorOptions
+		status   int
+		// code 开始输出后为 X-Scan-Code，否则为 JSON 响应的 Code
+		code string
+	}{
+		{name: "success", emulator: scanner.EmulatorOptions{Sheets: 2}, status: http.StatusOK, code: successCode},
+		{
+			name:     "fault while streaming",
+			emulator: scanner.EmulatorOptions{Sheets: 2, Fault: scanner.ErrPaperJam, FaultMidSheet: true},
+			status:   http.StatusOK,
+			code:     paperJamCode,
+		},
+		{
+			name:     "fault before streaming",
+			emulator: scanner.EmulatorOptions{Fault: scanner.ErrNoPaper},
+			status:   http.StatusUnprocessableEntity,
+			code:     noPaperCode,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner.Emulator = &tt.emulator
+			defer func() { scanner.Emulator = nil }()
+			DefaultAttachmentPath = t.TempDir()
+			router := Routes(AddWebRoutes)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/scan/stream?device=0000:7206&source=ADF&dpi=75&width=50&height=40", nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			resp := rec.Result()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d: %s", resp.StatusCode, tt.status, rec.Body)
+			}
+
+			if tt.status != http.StatusOK {
+				var body JSONResponse
+				if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+					t.Fatalf("decode error response: %v", err)
+				}
+				if body.Code != tt.code || resp.Trailer.Get(scanCodeTrailer) != "" {
+					t.Errorf("code %q, trailer %q, want a JSON error with code %s", body.Code, resp.Trailer.Get(scanCodeTrailer), tt.code)
+				}
+				return
+			}
+
+			if ct := resp.Header.Get("Content-Type"); ct != "image/jpeg" {
+				t.Errorf("content type %q, want image/jpeg", ct)
+			}
+			code, msg := resp.Trailer.Get(scanCodeTrailer), resp.Trailer.Get(scanErrorTrailer)
+			if code != tt.code {
+				t.Errorf("%s %q (%s %q), want %s", scanCodeTrailer, code, scanErrorTrailer, msg, tt.code)
+			}
+			if (msg == "") != (tt.code == successCode) {
+				t.Errorf("%s %q for code %s", scanErrorTrailer, msg, code)
+			}
+			if rec.Body.Len() == 0 {
+				t.Fatal("no image data streamed")
+			}
+			if _, err := jpeg.Decode(rec.Body); tt.code == successCode && err != nil {
+				t.Errorf("decode streamed page: %v", err)
+			}
+		})
+	}
+}
@@ -10,7 +10,14 @@ class Utils {
 
     static processFetchResponse(response) {
         if (!response.ok) {
-            throw new Error(`HTTP error! status: ${response.status}`);
+            // 设备错误会在响应中带上错误信息和处理提示
+            return response.json()
+                .catch(() => {
+                    throw new Error(`HTTP error! status: ${response.status}`);
+                })
+                .then(data => {
+                    throw new Error(data.Help ? `${data.Msg}，${data.Help}` : data.Msg);
+                });
         }
         return response.json();
     }
@@ -41,7 +48,7 @@ class DOMManager {
 
     initializeElements() {
         const elementIds = [
-            'deviceList', 'scanForm', 'scanBtn', 'scanBtnText', 'scanProgress',
+            'deviceList', 'scanForm', 'scanBtn', 'scanBtnText', 'cancelScanBtn', 'scanProgress',
             'scanStatus', 'previewPlaceholder', 'imageContainer', 'imageInfo',
             'imageDimensions', 'imageSize', 'imageCanvas', 'zoomInBtn', 'zoomOutBtn',
             'fitBtn', 'downloadBtn', 'scanHistory', 'historyPlaceholder', 'toast', 'toastMessage'
@@ -164,23 +171,48 @@ class DeviceManager {
 
         if (!devices || devices.length === 0) {
             dom.get('deviceList').innerHTML = DeviceManager.getEmptyDeviceTemplate();
+            state.updateSelectedDevice(null);
             return;
         }
 
+        // 列表刷新后保持原来选中的设备，否则默认选择第一个设备
+        const selected = state.getSelectedDevice();
+        const selectedIndex = Math.max(0, devices.findIndex(device => selected && device.ID === selected.ID));
+
         const html = devices.map((device, index) =>
-            DeviceManager.getDeviceItemTemplate(device, index)
+            DeviceManager.getDeviceItemTemplate(device, index, selectedIndex)
         ).join('');
 
         dom.get('deviceList').innerHTML = html;
 
-        // 默认选择第一个设备
-        if (devices.length > 0) {
-            state.updateSelectedDevice(devices[0]);
+        if (!selected || selected.ID !== devices[selectedIndex].ID) {
+            state.updateSelectedDevice(devices[selectedIndex]);
+            CapabilityManager.loadCapabilities(devices[selectedIndex]);
         }
 
         DeviceManager.bindDeviceEvents(devices);
     }
 
+    // 订阅设备插拔事件，扫描仪开机或断开后自动刷新列表
+    static watchDevices() {
+        if (!window.EventSource) return;
+
+        const source = new EventSource('/api/devices/events');
+        source.addEventListener('devices', event => {
+            DeviceManager.renderDeviceList(JSON.parse(event.data));
+        });
+        source.addEventListener('attached', event => {
+            const data = JSON.parse(event.data);
+            DeviceManager.renderDeviceList(data.Devices);
+            UIManager.showStatus(`设备已连接: ${data.Device.Name || data.Device.ID}`);
+        });
+        source.addEventListener('detached', event => {
+            const data = JSON.parse(event.data);
+            DeviceManager.renderDeviceList(data.Devices);
+            UIManager.showStatus(`设备已断开: ${data.Device.Name || data.Device.ID}`);
+        });
+    }
+
     static getEmptyDeviceTemplate() {
         return `
                     <div class="text-center py-5">
@@ -191,12 +223,12 @@ class DeviceManager {
                 `;
     }
 
-    static getDeviceItemTemplate(device, index) {
-        const activeClass = index === 0 ? 'active' : '';
+    static getDeviceItemTemplate(device, index, selectedIndex = 0) {
+        const activeClass = index === selectedIndex ? 'active' : '';
         return `
                     <div class="device-item ${activeClass}" data-index="${index}">
-                        <div class="device-name">${device.Name || '未知设备'}</div>
-                        <div class="device-id">${device.VendorID}:${device.ProductID}</div>
+                        <div class="device-name">${device.Name || '未知设备'}${device.SerialNumber ? ` (SN ${device.SerialNumber})` : ''}</div>
+                        <div class="device-id">${device.ID || `${device.VendorID}:${device.ProductID}`}${device.Path ? ` · USB ${device.Path}` : ''}</div>
                     </div>
                 `;
     }
@@ -209,11 +241,62 @@ class DeviceManager {
                 this.classList.add('active');
                 const index = parseInt(this.getAttribute('data-index'));
                 state.updateSelectedDevice(devices[index]);
+                CapabilityManager.loadCapabilities(devices[index]);
             });
         });
     }
 }
 
+// 设备能力管理器 - 根据设备能力过滤表单选项
+class CapabilityManager {
+    static loadCapabilities(device) {
+        if (!device || !device.ID) return;
+
+        return fetch(`/api/devices/${encodeURIComponent(device.ID)}/capabilities`)
+            .then(Utils.processFetchResponse)
+            .then(data => {
+                if (data.Code !== '0') {
+                    UIManager.showError('读取设备能力失败: ' + data.Msg);
+                    return;
+                }
+                CapabilityManager.applyCapabilities(data.Data);
+                return data.Data;
+            })
+            .catch(error => {
+                Utils.handleFetchError(error, '读取设备能力');
+            });
+    }
+
+    static applyCapabilities(caps) {
+        if (!caps) return;
+
+        CapabilityManager.filterOptions('dpi', (caps.Resolutions || []).map(String));
+        CapabilityManager.filterOptions('mode', caps.Modes || []);
+        CapabilityManager.filterOptions('source', [
+            caps.Flatbed && 'FLATBED',
+            caps.ADF && 'ADF',
+            caps.Duplex && 'ADF_DUPLEX'
+        ].filter(Boolean));
+    }
+
+    // 隐藏设备不支持的选项，如果当前选中项被隐藏则切换到第一个可用项
+    static filterOptions(selectId, supported) {
+        const select = document.getElementById(selectId);
+        if (!select || supported.length === 0) return;
+
+        Array.from(select.options).forEach(option => {
+            const available = supported.includes(option.value);
+            option.hidden = !available;
+            option.disabled = !available;
+        });
+
+        if (select.selectedOptions.length === 0 || select.selectedOptions[0].disabled) {
+            const first = Array.from(select.options).find(option => !option.disabled);
+            if (first) select.value = first.value;
+        }
+    }
+}
+
 // 扫描管理器 - 命令模式
 class ScanManager {
     static handleScan(event) {
@@ -237,9 +320,16 @@ class ScanManager {
     }
 
     static getScanOptions() {
+        const format = document.getElementById('format').value;
         return {
             DPI: parseInt(document.getElementById('dpi').value),
             Mode: document.getElementById('mode').value,
+            Source: document.getElementById('source').value,
+            // 无损格式需要设备发送 RLENGTH 原始数据，JPEG 由服务端按扫描模式选择
+            Compression: format === 'JPEG' ? '' : 'RLENGTH',
+            Format: format,
+            Brightness: parseInt(document.getElementById('brightness').value),
+            Contrast: parseInt(document.getElementById('contrast').value),
             Width: parseFloat(document.getElementById('width').value),
             Height: parseFloat(document.getElementById('height').value),
             Left: parseFloat(document.getElementById('left').value),
@@ -249,10 +339,9 @@ class ScanManager {
 
     static executeScan(requestData, scanOptions) {
         UIManager.disableScanButton();
-        const progressController = new ProgressController();
-        progressController.start();
 
-        fetch('/api/scan', {
+        // 创建扫描任务后立即返回，之后查询任务状态
+        fetch('/api/jobs', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json'
@@ -261,11 +350,12 @@ class ScanManager {
         })
             .then(Utils.processFetchResponse)
             .then(data => {
-                progressController.complete();
-                return ScanManager.handleScanResponse(data, requestData, scanOptions);
+                if (data.Code !== '0') {
+                    throw new Error(data.Msg);
+                }
+                JobManager.track(data.Data.ID, scanOptions);
             })
             .catch(error => {
-                progressController.error();
                 Utils.handleFetchError(error, '扫描');
                 UIManager.resetScanButton();
             });
@@ -278,55 +368,147 @@ class ScanManager {
             return;
         }
 
-        UIManager.showStatus('扫描完成');
+        const pages = data.Data.Pages || [data.Data.URL];
+        UIManager.showStatus(pages.length > 1 ? `扫描完成，共 ${pages.length} 页` : '扫描完成');
         ImageManager.displayImage(data.Data.URL);
-        HistoryManager.addToScanHistory({
-            device: requestData.device,
-            options: scanOptions,
-            filePath: data.Data.URL,
-            timestamp: new Date().toLocaleString()
+        const timestamp = new Date().toLocaleString();
+        // 倒序加入，使第一页显示在历史记录最前面
+        pages.slice().reverse().forEach(url => {
+            HistoryManager.addToScanHistory({
+                device: requestData.device,
+                options: scanOptions,
+                filePath: url,
+                timestamp: timestamp
+            });
+        });
+        UIManager.resetScanButton();
+    }
+}
+
+// 扫描任务管理器 - 任务在服务端执行，刷新页面后继续跟踪未完成的任务
+class JobManager {
+    static track(jobId, scanOptions) {
+        localStorage.setItem('scanJob', JSON.stringify({ id: jobId, options: scanOptions }));
+        UIManager.disableScanButton();
+        UIManager.showCancelButton(true);
+
+        JobManager.jobId = jobId;
+        JobManager.progressController = new ProgressController();
+        JobManager.progressController.start();
+        JobManager.watch(jobId, scanOptions);
+    }
+
+    static resume() {
+        const saved = localStorage.getItem('scanJob');
+        if (!saved) {
+            return;
+        }
+        try {
+            const job = JSON.parse(saved);
+            JobManager.track(job.id, job.options);
+        } catch (error) {
+            localStorage.removeItem('scanJob');
+        }
+    }
+
+    // 通过 SSE 接收任务进度，任务结束后服务端关闭连接
+    static watch(jobId, scanOptions) {
+        const source = new EventSource(`/api/jobs/${jobId}/events`);
+        JobManager.source = source;
+
+        const update = event => JobManager.progressController.update(JSON.parse(event.data));
+        ['queued', 'connecting', 'negotiating', 'scanning', 'page_complete'].forEach(name => {
+            source.addEventListener(name, update);
+        });
+        source.addEventListener('done', event => {
+            const job = JSON.parse(event.data);
+            JobManager.finish(true);
+            ScanManager.handleScanResponse({ Code: '0', Data: job.Result }, job.Req, scanOptions);
+        });
+        source.addEventListener('canceled', () => {
+            JobManager.finish(false);
+            UIManager.showStatus('扫描已取消');
+        });
+        source.addEventListener('failed', event => {
+            const job = JSON.parse(event.data);
+            JobManager.finish(false);
+            UIManager.showError(job.Help ? `扫描失败: ${job.Error}，${job.Help}` : `扫描失败: ${job.Error}`);
+        });
+        source.addEventListener('error', () => {
+            // 连接断开时浏览器会自动重连，任务不存在（例如服务重启）时不再重连
+            if (source.readyState === EventSource.CLOSED) {
+                JobManager.finish(false);
+                UIManager.showError('扫描任务已不存在');
+            }
         });
+    }
+
+    static cancel() {
+        if (!JobManager.jobId) {
+            return;
+        }
+        fetch(`/api/jobs/${JobManager.jobId}`, { method: 'DELETE' })
+            .then(Utils.processFetchResponse)
+            .catch(error => Utils.handleFetchError(error, '取消扫描'));
+    }
+
+    static finish(success) {
+        if (JobManager.source) {
+            JobManager.source.close();
+            JobManager.source = null;
+        }
+        localStorage.removeItem('scanJob');
+        JobManager.jobId = null;
+        if (JobManager.progressController) {
+            success ? JobManager.progressController.complete() : JobManager.progressController.error();
+        }
+        UIManager.showCancelButton(false);
         UIManager.resetScanButton();
     }
 }
 
-// 进度控制器
+// 进度控制器 - 显示服务端估算的当前页进度
 class ProgressController {
     constructor() {
-        this.progress = 0;
-        this.interval = null;
         this.dom = new DOMManager();
     }
 
     start() {
-        this.progress = 0;
-        this.dom.get('scanProgress').style.width = '0%';
+        this.setProgress(0);
         UIManager.showStatus('正在准备扫描...');
+    }
 
-        this.interval = setInterval(() => {
-            this.progress += 95 / 350; // 35秒达到95%
-            if (this.progress >= 95) {
-                this.progress = 95;
-            }
-            this.dom.get('scanProgress').style.width = this.progress + '%';
-            UIManager.showStatus(`扫描中... ${Math.round(this.progress)}%`);
-        }, 100);
+    update(job) {
+        const stageMessages = {
+            QUEUED: '设备正忙，排队等待中...',
+            CONNECTING: '正在连接设备...',
+            NEGOTIATING: '正在设置扫描参数...'
+        };
+        const stage = job.Stage || 'QUEUED';
+        if (stageMessages[stage]) {
+            this.setProgress(0);
+            UIManager.showStatus(stageMessages[stage]);
+            return;
+        }
+
+        this.setProgress(job.Percent);
+        const page = stage === 'PAGE_COMPLETE' ? job.PagesDone : job.PagesDone + 1;
+        const received = (job.BytesReceived / 1024).toFixed(0);
+        UIManager.showStatus(stage === 'PAGE_COMPLETE'
+            ? `第 ${page} 页扫描完成，已接收 ${received} KB`
+            : `正在扫描第 ${page} 页... ${job.Percent}%，已接收 ${received} KB`);
     }
 
     complete() {
-        if (this.interval) {
-            clearInterval(this.interval);
-            this.interval = null;
-        }
-        this.dom.get('scanProgress').style.width = '100%';
+        this.setProgress(100);
     }
 
     error() {
-        if (this.interval) {
-            clearInterval(this.interval);
-            this.interval = null;
-        }
-        this.dom.get('scanProgress').style.width = '100%';
+        this.setProgress(100);
+    }
+
+    setProgress(percent) {
+        this.dom.get('scanProgress').style.width = percent + '%';
     }
 }
 
@@ -737,6 +919,10 @@ class SettingsManager {
         return {
             dpi: document.getElementById('dpi').value,
             mode: document.getElementById('mode').value,
+            source: document.getElementById('source').value,
+            format: document.getElementById('format').value,
+            brightness: document.getElementById('brightness').value,
+            contrast: document.getElementById('contrast').value,
             width: document.getElementById('width').value,
             height: document.getElementById('height').value,
             left: document.getElementById('left').value,
@@ -768,6 +954,10 @@ class SettingsManager {
         const optionMap = {
             dpi: options.dpi || '400',
             mode: options.mode || 'CGRAY',
+            source: options.source || 'ADF',
+            format: options.format || 'JPEG',
+            brightness: options.brightness || '0',
+            contrast: options.contrast || '0',
             width: options.width || '211.881',
             height: options.height || '355.567',
             left: options.left || '0',
@@ -778,6 +968,7 @@ class SettingsManager {
             const element = document.getElementById(id);
             if (element) element.value = value;
         });
+        UIManager.updateRangeLabels();
     }
 }
 
@@ -792,6 +983,17 @@ class UIManager {
             (event) => ScanManager.handleScan(event));
         document.getElementById('clearHistoryBtn').addEventListener('click',
             () => HistoryManager.clearScanHistory());
+        dom.get('cancelScanBtn').addEventListener('click',
+            () => JobManager.cancel());
+        ['brightness', 'contrast'].forEach(id => {
+            document.getElementById(id).addEventListener('input', () => UIManager.updateRangeLabels());
+        });
+    }
+
+    static updateRangeLabels() {
+        ['brightness', 'contrast'].forEach(id => {
+            document.getElementById(id + 'Value').textContent = document.getElementById(id).value;
+        });
     }
 
     static showStatus(message) {
@@ -834,6 +1036,11 @@ class UIManager {
         dom.get('scanBtnText').innerHTML = '<span class="spinner" style="border-width: 2px; width: 16px; height: 16px; margin-right: 8px;"></span>扫描中...';
     }
 
+    static showCancelButton(visible) {
+        const dom = new DOMManager();
+        dom.get('cancelScanBtn').style.display = visible ? 'block' : 'none';
+    }
+
     static resetScanButton() {
         const dom = new DOMManager();
         dom.get('scanBtn').disabled = false;
@@ -870,9 +1077,11 @@ class ScannerApp {
         new StateManager(); // 确保状态管理器被初始化
 
         DeviceManager.loadDevices();
+        DeviceManager.watchDevices();
         UIManager.setupEventListeners();
         HistoryManager.loadScanHistory();
         SettingsManager.loadSavedSettings();
+        JobManager.resume();
     }
 }
 